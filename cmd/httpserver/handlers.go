@@ -4,103 +4,72 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
 
-	"github.com/isotronic/httpfromtcp/internal/headers"
 	"github.com/isotronic/httpfromtcp/internal/request"
 	"github.com/isotronic/httpfromtcp/internal/response"
+	"github.com/isotronic/httpfromtcp/internal/router"
+	"github.com/isotronic/httpfromtcp/internal/server"
 )
 
-func handleRequest(w *response.Writer, req *request.Request) {
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		handleChunk(w, req)
-		return
-	}
-
-	if req.RequestLine.RequestTarget == "/video" {
-		handleVideo(w)
-		return
-	}
-
-	if req.RequestLine.RequestTarget == "/yourproblem" {
-		handle400(w)
-		return
-	}
-
-	if req.RequestLine.RequestTarget == "/myproblem" {
-		handle500(w)
-		return
-	}
-
-	if req.RequestLine.RequestTarget == "/" {
-		handle200(w)
-		return
-	}
+func newRouter() *router.Router {
+	r := router.New()
+	r.Handle("GET /", handle200)
+	r.Handle("GET /video", handleVideo)
+	r.Handle("GET /yourproblem", handle400)
+	r.Handle("GET /myproblem", handle500)
+	r.Handle("GET /httpbin/*", handleChunk)
+	return r
 }
 
-func handleChunk(w *response.Writer, req *request.Request) {
-	url := "https://httpbin.org/" + strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
+func handleChunk(w *response.Writer, req *request.Request) error {
+	url := "https://httpbin.org/" + req.PathValue("*")
+	if req.RawQuery != "" {
+		url += "?" + req.RawQuery
+	}
 
 	res, err := http.Get(url)
 	if err != nil {
-		h := response.GetDefaultHeaders(len(err.Error()))
-		w.WriteStatusLine(response.StatusInternalServerError)
-		w.WriteHeaders(h)
-		w.WriteBody([]byte(err.Error()))
-		return
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
 	}
 	defer res.Body.Close()
 
-	h := response.GetDefaultHeaders(0)
-	h.Remove("Content-Length")
-	h.Add("Transfer-Encoding", "chunked")
-	h.Add("Trailer", "X-Content-SHA256, X-Content-Length")
-	w.WriteStatusLine(response.StatusOK)
-	w.WriteHeaders(h)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("Trailer", "X-Content-SHA256, X-Content-Length")
 
-	rawBody := make([]byte, 0)
-	buf := make([]byte, 1024)
-	for {
-		n, err := res.Body.Read(buf)
-		if n > 0 {
-			rawBody = append(rawBody, buf[:n]...)
-			w.WriteChunkedBody(buf[:n])
-		}
-
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Println(err)
-			break
-		}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), res.Body)
+	if err != nil {
+		// Leave the chunked body unterminated so the client sees it was cut
+		// short
+		return err
 	}
-	t := headers.NewHeaders()
-	sum := sha256.Sum256(rawBody)
-	length := strconv.Itoa(len(rawBody))
-	t.Add("X-Content-SHA256", fmt.Sprintf("%x", sum))
-	t.Add("X-Content-Length", length)
-	w.WriteChunkedBodyDone()
-	w.WriteTrailers(t)
+	// Sent after the last chunk once the handler returns
+	w.Trailer().Set("X-Content-SHA256", fmt.Sprintf("%x", hash.Sum(nil)))
+	w.Trailer().Set("X-Content-Length", strconv.FormatInt(n, 10))
+	return nil
 }
 
-func handleVideo(w *response.Writer) {
-	f, err := os.ReadFile("assets/vim.mp4")
+func handleVideo(w *response.Writer, _ *request.Request) error {
+	f, err := os.Open("assets/vim.mp4")
 	if err != nil {
-		log.Println(err)
+		return err
 	}
-	h := response.GetDefaultHeaders(len(f))
-	h.Override("Content-Type", "video/mp4")
-	w.WriteStatusLine(response.StatusOK)
-	w.WriteHeaders(h)
-	w.WriteBody(f)
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	_, err = io.Copy(w, f)
+	return err
 }
 
-func handle500(w *response.Writer) {
+func handle500(w *response.Writer, _ *request.Request) error {
 	body := `
 		<html>
 			<head>
@@ -113,13 +82,14 @@ func handle500(w *response.Writer) {
 		</html>
 	`
 	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteStatusLine(response.StatusInternalServerError)
 	w.WriteHeaders(h)
-	w.WriteBody([]byte(body))
+	_, err := w.WriteBody([]byte(body))
+	return err
 }
 
-func handle400(w *response.Writer) {
+func handle400(w *response.Writer, _ *request.Request) error {
 	body := `
 		<html>
 			<head>
@@ -132,13 +102,14 @@ func handle400(w *response.Writer) {
 		</html>
 	`
 	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteStatusLine(response.StatusBadRequest)
 	w.WriteHeaders(h)
-	w.WriteBody([]byte(body))
+	_, err := w.WriteBody([]byte(body))
+	return err
 }
 
-func handle200(w *response.Writer) {
+func handle200(w *response.Writer, _ *request.Request) error {
 	body := `
 		<html>
 			<head>
@@ -151,8 +122,9 @@ func handle200(w *response.Writer) {
 		</html>
 	`
 	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteStatusLine(response.StatusOK)
 	w.WriteHeaders(h)
-	w.WriteBody([]byte(body))
+	_, err := w.WriteBody([]byte(body))
+	return err
 }
\ No newline at end of file
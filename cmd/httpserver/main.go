@@ -1,26 +1,36 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/isotronic/httpfromtcp/internal/server"
 )
 
 const port = 42069
+const shutdownTimeout = 30 * time.Second
 
 func main() {
-	server, err := server.Serve(port, handleRequest)
+	server, err := server.Serve(port, server.Chain(newRouter().Dispatch, server.Logging(nil), server.Recover, server.RequestID))
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+
+	// Let in-flight requests (e.g. video downloads) finish before exiting
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
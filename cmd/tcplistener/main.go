@@ -35,8 +35,8 @@ func main() {
 		fmt.Printf("- Version: %v\n", req.RequestLine.HttpVersion)
 
 		fmt.Println("Headers:")
-		for header := range req.Headers {
-			fmt.Printf("- %v: %v\n", header, req.Headers[header])
+		for _, field := range req.Headers {
+			fmt.Printf("- %v: %v\n", field.Name, field.Value)
 		}
 
 		fmt.Println("Body:")
@@ -1,71 +1,255 @@
 package headers
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"strings"
 )
 
-type Headers map[string]string
+// Field is a single header field line
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Headers holds header fields in the order they were received or added, with
+// the casing of their names preserved. Lookups ignore case.
+type Headers []Field
 
 const CRLF = "\r\n"
 const VALIDCHAR = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!#$%&'*+-.^_`|~"
 
+// Errors returned by Parse, use errors.Is to check for them
+var (
+	ErrMalformedFieldLine = errors.New("malformed header field line")
+	ErrInvalidFieldName   = errors.New("invalid header field name")
+	ErrInvalidFieldValue  = errors.New("invalid header field value")
+)
+
 func NewHeaders() Headers {
 	return Headers{}
 }
 
-func (h Headers) Add(key, value string) {
-	key = strings.ToLower(key)
-	if existingValue, ok := h[key]; ok {
-		h[key] = existingValue + ", " + value
-	} else {
-		h[key] = value
+// Get returns the values of key joined with ", ", or "" if it isn't set.
+// Set-Cookie values can't be combined, so only the first one is returned for
+// it; use Values to get all of them.
+func (h Headers) Get(key string) string {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return ""
+	}
+	if strings.EqualFold(key, "Set-Cookie") {
+		return values[0]
+	}
+	return strings.Join(values, ", ")
+}
+
+// Values returns the value of every field line for key, in order
+func (h Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h {
+		if strings.EqualFold(f.Name, key) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Has reports whether there is at least one field line for key
+func (h Headers) Has(key string) bool {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add appends a field line, keeping any existing ones for key
+func (h *Headers) Add(key, value string) {
+	*h = append(*h, Field{Name: key, Value: value})
+}
+
+// Set replaces the field lines for key with a single one. It takes the place
+// of the first existing line, or is appended if there is none.
+func (h *Headers) Set(key, value string) {
+	fields := (*h)[:0]
+	set := false
+	for _, f := range *h {
+		if !strings.EqualFold(f.Name, key) {
+			fields = append(fields, f)
+		} else if !set {
+			fields = append(fields, Field{Name: key, Value: value})
+			set = true
+		}
+	}
+	if !set {
+		fields = append(fields, Field{Name: key, Value: value})
+	}
+	*h = fields
+}
+
+// Del removes every field line for key
+func (h *Headers) Del(key string) {
+	fields := (*h)[:0]
+	for _, f := range *h {
+		if !strings.EqualFold(f.Name, key) {
+			fields = append(fields, f)
+		}
+	}
+	*h = fields
+}
+
+// Clone returns a copy of h that can be changed independently
+func (h Headers) Clone() Headers {
+	if h == nil {
+		return nil
 	}
+	return append(Headers{}, h...)
 }
 
-func (h Headers) Override(key, value string) {
-	key = strings.ToLower(key)
-	h[key] = value
+// HasToken reports whether the comma-separated lists in the given header
+// contain token, compared case-insensitively (e.g. "Connection: close")
+func (h Headers) HasToken(key, token string) bool {
+	for _, value := range strings.Split(h.Get(key), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+	return false
 }
 
-func (h Headers) Remove(key string) {
-	key = strings.ToLower(key)
-	delete(h, key)
+// Validate checks that every field has a valid name and value, so h can be
+// written without splitting the message
+func (h Headers) Validate() error {
+	for _, f := range h {
+		if !ValidFieldName(f.Name) {
+			return fmt.Errorf("%w: %q", ErrInvalidFieldName, f.Name)
+		}
+		if !ValidFieldValue(f.Value) {
+			return fmt.Errorf("%w: %q for %q", ErrInvalidFieldValue, f.Value, f.Name)
+		}
+	}
+	return nil
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
-	str := string(data)
-	if !strings.Contains(str, CRLF) {
-		return 0, false, nil
+// ValidFieldName reports whether name is a non-empty token
+func ValidFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, char := range name {
+		if !strings.Contains(VALIDCHAR, string(char)) {
+			return false
+		}
 	}
+	return true
+}
 
-	if strings.Index(str, CRLF) == 0 {
-		return 2, true, nil
+// ValidFieldValue reports whether value only contains visible characters,
+// obs-text (bytes 0x80-0xff), spaces and tabs. In particular CR and LF are
+// rejected so a value can't start a new field line.
+func ValidFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
 	}
+	return true
+}
 
-	firstHeader := strings.Split(str, CRLF)[0]
-	line := strings.TrimSpace(firstHeader)
-	pair := strings.SplitN(line, ":", 2)
-	keyValid := strings.TrimSpace(pair[0])
-	if len(keyValid) != len(pair[0]) {
-		return 0, false, fmt.Errorf("invalid spacing in header")
+// Parse parses one field line from data, or the empty line ending the
+// headers, in which case done is true. It returns 0 bytes if data doesn't
+// hold a complete line yet. Lines must end in CRLF and obsolete line folding
+// is rejected; use ParseLenient to accept them.
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.parse(data, false)
+}
+
+// ParseLenient is like Parse but also accepts lines ending in a bare LF and
+// replaces obsolete line folding (a line starting with a space or tab that
+// continues the previous value) with a single space, as RFC 9112 allows.
+func (h *Headers) ParseLenient(data []byte) (n int, done bool, err error) {
+	return h.parse(data, true)
+}
+
+func (h *Headers) parse(data []byte, lenient bool) (n int, done bool, err error) {
+	line, n, err := readLine(data, lenient)
+	if n == 0 || err != nil {
+		return 0, false, err
+	}
+	if line == "" {
+		return n, true, nil
 	}
-	if len(keyValid) == 0 {
-		return 0, false, fmt.Errorf("invalid header key")
+	if line[0] == ' ' || line[0] == '\t' {
+		// Folding can only continue a value, which lenient parsing has
+		// already consumed along with the line it belongs to
+		return 0, false, fmt.Errorf("%w: obsolete line folding in %q", ErrMalformedFieldLine, line)
+	}
+
+	name, value, found := strings.Cut(line, ":")
+	if !found {
+		return 0, false, fmt.Errorf("%w: missing colon in %q", ErrMalformedFieldLine, line)
 	}
-	for _, char := range keyValid {
+	if strings.TrimRight(name, " \t") != name {
+		return 0, false, fmt.Errorf("%w: whitespace around %q", ErrInvalidFieldName, name)
+	}
+	if len(name) == 0 {
+		return 0, false, fmt.Errorf("%w: empty name", ErrInvalidFieldName)
+	}
+	for _, char := range name {
 		if !strings.Contains(VALIDCHAR, string(char)) {
-			return 0, false, fmt.Errorf("invalid character in header key")
+			return 0, false, fmt.Errorf("%w: invalid character %q in %q", ErrInvalidFieldName, char, name)
 		}
 	}
+	value = strings.Trim(value, " \t")
 
-	lowerCaseKey := strings.ToLower(keyValid)
-	_, ok := h[lowerCaseKey]
-	if ok {
-		h[lowerCaseKey] += ", " + strings.TrimSpace(pair[1])
-	} else {
-		h[lowerCaseKey] = strings.TrimSpace(pair[1])
+	if lenient {
+		// Unfold continuation lines. Whether the next line continues this
+		// one is only known once its first byte has arrived.
+		for {
+			if n == len(data) {
+				return 0, false, nil
+			}
+			if data[n] != ' ' && data[n] != '\t' {
+				break
+			}
+			next, m, err := readLine(data[n:], lenient)
+			if m == 0 || err != nil {
+				return 0, false, err
+			}
+			if next = strings.Trim(next, " \t"); next != "" {
+				if value != "" {
+					value += " "
+				}
+				value += next
+			}
+			n += m
+		}
 	}
 
-	return len(firstHeader) + 2, false, nil
+	if !ValidFieldValue(value) {
+		return 0, false, fmt.Errorf("%w: %q for %q", ErrInvalidFieldValue, value, name)
+	}
+	h.Add(name, value)
+	return n, false, nil
+}
+
+// readLine returns the first line in data without its line ending and the
+// number of bytes it takes up, or 0 if the line isn't complete yet. A bare
+// LF ending is an error unless lenient is set.
+func readLine(data []byte, lenient bool) (string, int, error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return "", 0, nil
+	}
+	if i > 0 && data[i-1] == '\r' {
+		return string(data[:i-1]), i + 1, nil
+	}
+	if !lenient {
+		return "", 0, fmt.Errorf("%w: line ends in a bare LF", ErrMalformedFieldLine)
+	}
+	return string(data[:i]), i + 1, nil
 }
@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,7 +15,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", headers.Get("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -24,12 +25,12 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", headers.Get("host"))
 	assert.Equal(t, 30, n)
 	assert.False(t, done)
 
 	// Test: Valid multiple headers with existing headers
-	headers = Headers{"content-type": "application/json"}
+	headers = Headers{{Name: "Content-Type", Value: "application/json"}}
 	data = []byte("Host: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	var totalBytes int
 	for !done {
@@ -38,10 +39,10 @@ func TestHeadersParse(t *testing.T) {
 		totalBytes += n
 	}
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
-	assert.Equal(t, "*/*", headers["accept"])
-	assert.Equal(t, "application/json", headers["content-type"])
+	assert.Equal(t, "localhost:42069", headers.Get("host"))
+	assert.Equal(t, "curl/7.81.0", headers.Get("user-agent"))
+	assert.Equal(t, "*/*", headers.Get("accept"))
+	assert.Equal(t, "application/json", headers.Get("content-type"))
 	assert.Equal(t, 63, totalBytes)
 
 	// Test: Valid multiple different values with the same key
@@ -55,7 +56,7 @@ func TestHeadersParse(t *testing.T) {
 		totalBytes += n
 	}
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069, localhost:42070", headers["host"])
+	assert.Equal(t, "localhost:42069, localhost:42070", headers.Get("host"))
 	assert.Equal(t, 48, totalBytes)
 	assert.True(t, done)
 
@@ -81,6 +82,241 @@ func TestHeadersParse(t *testing.T) {
 	data = []byte("H@st: localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrInvalidFieldName)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
+
+	// Test: Control character in value
+	headers = Headers{}
+	data = []byte("X-Name: a\x00b\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrInvalidFieldValue)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Bare CR in value
+	headers = Headers{}
+	data = []byte("X-Name: a\rSet-Cookie: b\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	assert.ErrorIs(t, err, ErrInvalidFieldValue)
+
+	// Test: Tabs and obs-text are allowed in values
+	headers = Headers{}
+	data = []byte("X-Name:\tcaf\xe9\tau lait \r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, "caf\xe9\tau lait", headers.Get("X-Name"))
+	assert.False(t, done)
+
+	// Test: Missing colon
+	headers = Headers{}
+	data = []byte("Host\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrMalformedFieldLine)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+
+func TestHeadersMultiValue(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Content-Type", "text/plain")
+	h.Add("Set-Cookie", "a=1; Path=/")
+	h.Add("Cache-Control", "no-cache")
+	h.Add("set-cookie", "b=2, c=3")
+	h.Add("Cache-Control", "no-store")
+
+	// Test: Lookups ignore case and keep every value in order
+	assert.Equal(t, "no-cache, no-store", h.Get("cache-control"))
+	assert.Equal(t, []string{"a=1; Path=/", "b=2, c=3"}, h.Values("SET-COOKIE"))
+	assert.True(t, h.Has("content-type"))
+	assert.Equal(t, "", h.Get("Accept"))
+	assert.Nil(t, h.Values("Accept"))
+
+	// Test: Set-Cookie values are never combined
+	assert.Equal(t, "a=1; Path=/", h.Get("Set-Cookie"))
+
+	// Test: Field lines keep their order and casing
+	assert.Equal(t, Field{Name: "set-cookie", Value: "b=2, c=3"}, h[3])
+
+	// Test: Clone is independent of the original
+	c := h.Clone()
+	c.Set("Content-Type", "text/html")
+	assert.Equal(t, "text/plain", h.Get("Content-Type"))
+
+	// Test: Set replaces every line in place of the first one
+	h.Set("cache-control", "max-age=60")
+	assert.Equal(t, Headers{
+		{Name: "Content-Type", Value: "text/plain"},
+		{Name: "Set-Cookie", Value: "a=1; Path=/"},
+		{Name: "cache-control", Value: "max-age=60"},
+		{Name: "set-cookie", Value: "b=2, c=3"},
+	}, h)
+
+	// Test: Set appends a missing field
+	h.Set("Accept", "*/*")
+	assert.Equal(t, Field{Name: "Accept", Value: "*/*"}, h[len(h)-1])
+
+	// Test: Del removes every line
+	h.Del("Set-Cookie")
+	assert.False(t, h.Has("Set-Cookie"))
+	assert.Len(t, h, 3)
+
+	// Test: Parse keeps duplicate lines separate
+	h = NewHeaders()
+	data := []byte("Set-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n")
+	n, _, err := h.Parse(data)
+	require.NoError(t, err)
+	_, _, err = h.Parse(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1", "b=2"}, h.Values("Set-Cookie"))
+}
+
+func TestValidate(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Location", "/next")
+	assert.NoError(t, h.Validate())
+
+	h.Add("X-Echo", "hi\r\nSet-Cookie: admin=1")
+	assert.ErrorIs(t, h.Validate(), ErrInvalidFieldValue)
+
+	h = Headers{{Name: "Bad Name", Value: "x"}}
+	assert.ErrorIs(t, h.Validate(), ErrInvalidFieldName)
+
+	h = Headers{{Name: "", Value: "x"}}
+	assert.ErrorIs(t, h.Validate(), ErrInvalidFieldName)
+}
+
+// parseAll parses a complete header block and returns the headers
+func parseAll(data []byte, lenient bool) (Headers, error) {
+	h := NewHeaders()
+	for {
+		var n int
+		var done bool
+		var err error
+		if lenient {
+			n, done, err = h.ParseLenient(data)
+		} else {
+			n, done, err = h.Parse(data)
+		}
+		if err != nil || done {
+			return h, err
+		}
+		if n == 0 {
+			return h, io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+	}
+}
+
+func TestParseLineEndings(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		strict error
+		want   Headers
+	}{
+		{
+			name:   "obs-fold",
+			data:   "X-Long: first\r\n  second\r\n\tthird \r\nHost: a\r\n\r\n",
+			strict: ErrMalformedFieldLine,
+			want:   Headers{{Name: "X-Long", Value: "first second third"}, {Name: "Host", Value: "a"}},
+		},
+		{
+			name:   "obs-fold after empty value",
+			data:   "X-Long:\r\n second\r\n\r\n",
+			strict: ErrMalformedFieldLine,
+			want:   Headers{{Name: "X-Long", Value: "second"}},
+		},
+		{
+			name:   "bare LF",
+			data:   "Host: a\nAccept: */*\n\n",
+			strict: ErrMalformedFieldLine,
+			want:   Headers{{Name: "Host", Value: "a"}, {Name: "Accept", Value: "*/*"}},
+		},
+		{
+			name:   "bare CR",
+			data:   "Host: a\rAccept: */*\r\n\r\n",
+			strict: ErrInvalidFieldValue,
+		},
+		{
+			name:   "leading whitespace on the first line",
+			data:   " Host: a\r\n\r\n",
+			strict: ErrMalformedFieldLine,
+		},
+		{
+			name:   "missing colon",
+			data:   "Host a\r\n\r\n",
+			strict: ErrMalformedFieldLine,
+		},
+		{
+			name:   "whitespace before colon",
+			data:   "Host : a\r\n\r\n",
+			strict: ErrInvalidFieldName,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseAll([]byte(tt.data), false)
+			assert.ErrorIs(t, err, tt.strict)
+
+			h, err := parseAll([]byte(tt.data), true)
+			if tt.want == nil {
+				assert.ErrorIs(t, err, tt.strict)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, h)
+		})
+	}
+
+	// Test: Folding waits for the first byte of the next line
+	h := NewHeaders()
+	n, done, err := h.ParseLenient([]byte("X-Long: first\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+	n, _, err = h.ParseLenient([]byte("X-Long: first\r\n second\r\nHost"))
+	require.NoError(t, err)
+	assert.Equal(t, 24, n)
+	assert.Equal(t, "first second", h.Get("X-Long"))
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"Host: localhost:42069\r\n\r\n",
+		"Set-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n",
+		"X-Long: first\r\n second\r\n\r\n",
+		"Host: a\nAccept: */*\n\n",
+		"Host\r\n\r\n",
+		"       Host : localhost:42069       \r\n\r\n",
+		"H@st: a\r\n\r\n",
+		"X: a\rb\r\n\r\n",
+		"X:\r\n\t\r\n\r\n",
+		"\r\n",
+		"\n",
+		":\r\n\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		strict, strictErr := parseAll(data, false)
+		lenient, lenientErr := parseAll(data, true)
+
+		// Whatever is accepted can be written back without splitting the
+		// message
+		if strictErr == nil {
+			require.NoError(t, strict.Validate())
+		}
+		if lenientErr == nil {
+			require.NoError(t, lenient.Validate())
+		}
+		// Lenient parsing accepts everything strict parsing does, with the
+		// same result
+		if strictErr == nil {
+			require.NoError(t, lenientErr)
+			require.Equal(t, strict, lenient)
+		}
+	})
 }
@@ -0,0 +1,91 @@
+package request
+
+import (
+	"fmt"
+	"io"
+)
+
+// maxDrainBytes is how much of an unread body is discarded to reuse the
+// connection for the next request. Larger leftovers close the connection.
+const maxDrainBytes = 256 << 10
+
+// bodyBufferSize is the minimum buffer size used while streaming a body, so
+// large bodies aren't read from the connection in tiny pieces
+const bodyBufferSize = 4096
+
+// body streams a request body from the connection, using the request's
+// parser to strip Content-Length or chunked framing
+type body struct {
+	req      *Request
+	reader   *Reader
+	closed   bool
+	closeErr error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, fmt.Errorf("error: read on closed body")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req := b.req
+	if req.expectContinue {
+		req.expectContinue = false
+		if req.sendContinue != nil {
+			if err := req.sendContinue(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(b.reader.buf) < bodyBufferSize {
+		newBuffer := make([]byte, bodyBufferSize)
+		copy(newBuffer, b.reader.buf[:b.reader.readToIndex])
+		b.reader.buf = newBuffer
+	}
+
+	req.out, req.outN = p, 0
+	defer func() {
+		req.out, req.outN = nil, 0
+	}()
+
+	for req.state != done && req.outN == 0 {
+		more, err := b.reader.advance(req)
+		if err != nil {
+			return req.outN, err
+		}
+		if !more {
+			return req.outN, fmt.Errorf("error: body ended early: %w", io.ErrUnexpectedEOF)
+		}
+	}
+	if req.outN > 0 {
+		return req.outN, nil
+	}
+	return 0, io.EOF
+}
+
+// Close discards the rest of the body so the next request can be read from
+// the connection. It fails with ErrBodyNotDrained if more than maxDrainBytes
+// are left, or if the client is still waiting for "100 Continue".
+func (b *body) Close() error {
+	if b.closed {
+		return b.closeErr
+	}
+	if b.req.expectContinue {
+		// The client is still waiting to be told to send the body. It may
+		// send it anyway, so the connection can't be reused.
+		b.closed = true
+		b.closeErr = ErrBodyNotDrained
+		return b.closeErr
+	}
+	n, err := io.CopyN(io.Discard, b, maxDrainBytes+1)
+	b.closed = true
+	switch {
+	case err == io.EOF:
+	case err != nil:
+		b.closeErr = err
+	case n > maxDrainBytes:
+		b.closeErr = ErrBodyNotDrained
+	}
+	return b.closeErr
+}
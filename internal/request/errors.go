@@ -0,0 +1,68 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned while parsing a request, wrapped in a *ParseError. Use
+// errors.Is to check for them. Header syntax errors wrap the headers
+// package's errors instead.
+var (
+	ErrInvalidRequestLine   = errors.New("invalid request line")
+	ErrInvalidMethod        = errors.New("invalid method")
+	ErrUnsupportedVersion   = errors.New("unsupported http version")
+	ErrInvalidTarget        = errors.New("invalid request target")
+	ErrRequestLineTooLong   = errors.New("request line too long")
+	ErrHeaderTooLarge       = errors.New("request header fields too large")
+	ErrInvalidContentLength = errors.New("invalid content length")
+	ErrUnsupportedEncoding  = errors.New("unsupported transfer encoding")
+	ErrConflictingFraming   = errors.New("both content-length and transfer-encoding present")
+	ErrInvalidChunk         = errors.New("invalid chunk")
+	ErrBodyTooLarge         = errors.New("request body too large")
+)
+
+// ErrBodyNotDrained is returned when closing a body whose unread remainder is
+// too large to discard, so the connection can't be used for another request
+var ErrBodyNotDrained = errors.New("request body too large to discard")
+
+// ParseError describes where parsing a request failed
+type ParseError struct {
+	// Offset is the byte offset in the request where the failing element
+	// (line, chunk, ...) starts
+	Offset int64
+	// State is what the parser was reading
+	State RequestState
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at byte %d (%s): %v", e.Offset, e.State, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (s RequestState) String() string {
+	switch s {
+	case initialized:
+		return "request line"
+	case parsingHeaders:
+		return "headers"
+	case parsingBody:
+		return "body"
+	case parsingChunkSize:
+		return "chunk size"
+	case parsingChunkData:
+		return "chunk data"
+	case parsingChunkDataEnd:
+		return "chunk end"
+	case parsingTrailers:
+		return "trailers"
+	case done:
+		return "done"
+	default:
+		return fmt.Sprintf("RequestState(%d)", int(s))
+	}
+}
@@ -0,0 +1,31 @@
+package request
+
+// Limits bounds how much a client may send, so a single connection can't
+// exhaust the server's memory. A zero field means no limit.
+type Limits struct {
+	// MaxRequestLineBytes limits the request line, without its CRLF
+	MaxRequestLineBytes int
+	// MaxHeaderBytes limits the total size of all header field lines,
+	// including trailers of a chunked body
+	MaxHeaderBytes int
+	// MaxHeaderCount limits the number of header field lines, including
+	// trailers of a chunked body
+	MaxHeaderCount int
+	// MaxBodyBytes limits the size of the (decoded) body
+	MaxBodyBytes int
+}
+
+// DefaultLimits are the limits used by NewReader
+var DefaultLimits = Limits{
+	MaxRequestLineBytes: 8 << 10,
+	MaxHeaderBytes:      1 << 20,
+	MaxHeaderCount:      100,
+}
+
+// maxChunkLineBytes limits a chunk size line including its extensions
+const maxChunkLineBytes = 4096
+
+// exceeds reports whether n is over limit, where a zero limit means none
+func exceeds(n, limit int) bool {
+	return limit > 0 && n > limit
+}
@@ -1,8 +1,10 @@
 package request
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"net/url"
 	"strconv"
 	"strings"
 	"unicode"
@@ -13,16 +15,99 @@ import (
 type Request struct {
 	RequestLine 		RequestLine
 	Headers     		headers.Headers
-	Body        		[]byte
 
+	// TargetForm is the form of RequestLine.RequestTarget. Path, RawPath,
+	// RawQuery and Query are parsed from it; Host is only set for the
+	// absolute and authority forms.
+	TargetForm TargetForm
+	Host       string
+
+	// Path is the percent-decoded path and RawPath the path as sent
+	Path    string
+	RawPath string
+
+	// RawQuery is the query without the "?" and Query its decoded values
+	RawQuery string
+	Query    url.Values
+
+	// BodyReader streams the body from the connection as the handler reads
+	// it. Chunked bodies are decoded and their trailers stored in Trailers
+	// once the end is reached.
+	BodyReader io.ReadCloser
+
+	// Body holds the whole body once ReadBody has been called
+	Body []byte
+
+	// Trailers holds the trailer fields sent after a chunked body
+	Trailers headers.Headers
+
+	// PathParams holds the path parameters matched by the router, keyed by
+	// name, with "*" for a trailing wildcard
+	PathParams map[string]string
+
+	limits         	Limits
+	lenient        	bool
+	offset         	int64
+	headerBytes    	int
+	headerCount    	int
+	contentLength  	int
 	bodyReadLength 	int
+	chunkRemaining 	int
 	state       		RequestState
+
+	// expectContinue is set while the client waits for "100 Continue"
+	// before sending the body, and sendContinue sends it
+	expectContinue bool
+	sendContinue   func() error
+
+	// out is where the body states of parse copy body bytes to
+	out  []byte
+	outN int
+}
+
+// ReadBody reads the rest of the body into Body and returns it. It is a
+// convenience for handlers that need the whole body at once; large uploads
+// are better consumed from BodyReader as they arrive.
+func (r *Request) ReadBody() ([]byte, error) {
+	body, err := io.ReadAll(r.BodyReader)
+	r.Body = append(r.Body, body...)
+	return r.Body, err
+}
+
+// PathValue returns the named path parameter matched by the router, or ""
+func (r *Request) PathValue(name string) string {
+	return r.PathParams[name]
+}
+
+// ExpectsContinue reports whether the client sent "Expect: 100-continue" and
+// is waiting for an interim response before sending the body. It stays true
+// until the body is first read.
+func (r *Request) ExpectsContinue() bool {
+	return r.expectContinue
+}
+
+// SetContinue sets the function that sends "100 Continue" to the client. It
+// is called when the body is first read, so a handler that rejects the
+// request without reading the body saves the client from sending it.
+func (r *Request) SetContinue(fn func() error) {
+	r.sendContinue = fn
 }
 
 type RequestLine struct {
 	HttpVersion   	string
 	RequestTarget 	string
 	Method        	string
+
+	// Major and Minor are the numbers of HttpVersion, e.g. 1 and 0 for
+	// HTTP/1.0
+	Major int
+	Minor int
+}
+
+// ProtoAtLeast reports whether the request's HTTP version is at least
+// major.minor
+func (rl RequestLine) ProtoAtLeast(major, minor int) bool {
+	return rl.Major > major || (rl.Major == major && rl.Minor >= minor)
 }
 
 type RequestState int
@@ -31,77 +116,161 @@ const (
 	initialized RequestState = iota
 	parsingHeaders
 	parsingBody
+	parsingChunkSize
+	parsingChunkData
+	parsingChunkDataEnd
+	parsingTrailers
 	done
 )
 
 const bufferSize = 8
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
-	req := Request{
-		state:   initialized,
-		Headers: headers.Headers{},
-	}
+// maxChunkSize keeps chunk sizes well within int range
+const maxChunkSize = 1 << 40
 
-	for {
-		if req.state == done {
-			break
-		}
+// Reader reads consecutive requests from a single connection. Bytes read past
+// the end of one request are kept for the next, so pipelined requests on a
+// persistent connection are not lost.
+type Reader struct {
+	// Limits is applied to every request read after it is set
+	Limits Limits
 
-		// Double the buffer size if it's full
-		if len(buf) == readToIndex {
-			newBuffer := make([]byte, len(buf)*2)
-			copy(newBuffer, buf)
-			buf = newBuffer
-		}
+	// Lenient makes header and trailer parsing accept lines ending in a
+	// bare LF and obsolete line folding, which are rejected by default
+	Lenient bool
 
-		// Always attempt to parse what we already have
-		parsedBytes, err := req.parse(buf[:readToIndex])
-		if err != nil {
-			return &req, err
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+	eof         bool
+
+	// current is the last request returned, whose body may not have been
+	// read yet
+	current *Request
+}
+
+// NewReader creates a new Reader reading from the given io.Reader
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		Limits: DefaultLimits,
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+	}
+}
+
+// Wait blocks until at least one byte of the next request is available. It
+// returns io.EOF if the connection is closed before that.
+func (r *Reader) Wait() error {
+	for r.readToIndex == 0 {
+		if r.eof {
+			return io.EOF
 		}
-		if parsedBytes > 0 {
-			// Shift remaining data left.
-			copy(buf, buf[parsedBytes:readToIndex])
-			readToIndex -= parsedBytes
-
-			// If parsing completed the request then break.
-			if req.state == done {
-				break
-			}
-		} else {
-			// No progress was made by parsing – try to read more data.
-			n, err := reader.Read(buf[readToIndex:])
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return &req, err
-			}
-			readToIndex += n
+		if err := r.fill(); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// Handle any remaining bytes in the buffer
-	if readToIndex > 0 && req.state != done {
-		_, err := req.parse(buf[:readToIndex])
-		if err != nil {
-			return &req, err
+// fill reads more data from the connection into the buffer, growing it if
+// it's full
+func (r *Reader) fill() error {
+	// Double the buffer size if it's full
+	if len(r.buf) == r.readToIndex {
+		newBuffer := make([]byte, len(r.buf)*2)
+		copy(newBuffer, r.buf)
+		r.buf = newBuffer
+	}
+
+	n, err := r.reader.Read(r.buf[r.readToIndex:])
+	r.readToIndex += n
+	if err == io.EOF {
+		r.eof = true
+		return nil
+	}
+	return err
+}
+
+// advance runs one parsing step of req on the buffered data, reading more
+// data first if needed. It reports false once the connection has reached EOF
+// and no more progress can be made.
+func (r *Reader) advance(req *Request) (bool, error) {
+	// Always attempt to parse what we already have
+	parsedBytes, err := req.parse(r.buf[:r.readToIndex])
+	if err != nil {
+		return false, &ParseError{Offset: req.offset, State: req.state, Err: err}
+	}
+	req.offset += int64(parsedBytes)
+	if parsedBytes > 0 {
+		// Shift remaining data left.
+		copy(r.buf, r.buf[parsedBytes:r.readToIndex])
+		r.readToIndex -= parsedBytes
+		return true, nil
+	}
+	if r.eof {
+		return false, nil
+	}
+
+	// No progress was made by parsing – try to read more data.
+	return true, r.fill()
+}
+
+// RequestFromReader reads a single request including its whole body, which
+// is stored in Body
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	req, err := NewReader(reader).ReadRequest()
+	if err != nil {
+		return req, err
+	}
+	_, err = req.ReadBody()
+	return req, err
+}
+
+// ReadRequest parses the request line and headers of the next request from
+// the connection. The body is not read up front but streamed through
+// BodyReader. Any unread body of the previous request is discarded first.
+// It returns io.EOF if the connection was closed before any byte of a new
+// request arrived.
+func (r *Reader) ReadRequest() (*Request, error) {
+	if r.current != nil {
+		if err := r.current.BodyReader.Close(); err != nil {
+			return nil, err
 		}
 	}
 
-	length, ok := req.Headers["content-length"]
-	if ok {
-		contentLength, err := strconv.Atoi(length)
+	req := &Request{
+		state:    initialized,
+		Headers:  headers.Headers{},
+		Trailers: headers.Headers{},
+		limits:   r.Limits,
+		lenient:  r.Lenient,
+	}
+	req.BodyReader = &body{req: req, reader: r}
+
+	for req.state == initialized || req.state == parsingHeaders {
+		more, err := r.advance(req)
 		if err != nil {
-			return &req, err
+			return req, err
 		}
-		if contentLength != len(req.Body) {
-			return &req, fmt.Errorf("error: content length does not match body length")
+		if !more {
+			break
 		}
 	}
 
-	return &req, nil
+	if req.state == initialized {
+		if r.readToIndex == 0 {
+			return req, io.EOF
+		}
+		return req, io.ErrUnexpectedEOF
+	}
+	if req.state == parsingHeaders {
+		// The connection ended without the blank line after the headers,
+		// take what we got as a request without a body
+		req.state = done
+	}
+
+	r.current = req
+	return req, nil
 }
 
 // parseRequestLine parses the request line and returns the number of bytes read
@@ -114,28 +283,147 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	}
 	parts := strings.Split(lines[0], " ")
 	if len(parts) != 3 {
-		return reqLine, 0, fmt.Errorf("invalid number of parts in request line: %s", lines[0])
+		return reqLine, 0, fmt.Errorf("%w: %q", ErrInvalidRequestLine, lines[0])
 	}
 
 	for _, char := range parts[0] {
 		if !unicode.IsUpper(char) {
-			return reqLine, 0, fmt.Errorf("invalid method: %s", parts[0])
+			return reqLine, 0, fmt.Errorf("%w: %q", ErrInvalidMethod, parts[0])
 		}
 	}
 
-	if parts[2] != "HTTP/1.1" {
-		return reqLine, 0, fmt.Errorf("invalid http version: %s", parts[2])
+	major, minor, err := parseVersion(parts[2])
+	if err != nil {
+		return reqLine, 0, err
 	}
 
-	versionParts := strings.Split(parts[2], "/")
-
 	reqLine.Method = parts[0]
 	reqLine.RequestTarget = parts[1]
-	reqLine.HttpVersion = versionParts[1]
+	reqLine.HttpVersion = parts[2][len("HTTP/"):]
+	reqLine.Major = major
+	reqLine.Minor = minor
 
 	return reqLine, len(lines[0]) + 2, nil
 }
 
+// parseVersion parses an "HTTP/x.y" version. Only HTTP/1.x is supported; a
+// 1.x newer than 1.1 is handled like 1.1.
+func parseVersion(version string) (int, int, error) {
+	num, found := strings.CutPrefix(version, "HTTP/")
+	if !found || len(num) != 3 || num[1] != '.' || !isDigit(num[0]) || !isDigit(num[2]) {
+		return 0, 0, fmt.Errorf("%w: invalid version %q", ErrInvalidRequestLine, version)
+	}
+	major, minor := int(num[0]-'0'), int(num[2]-'0')
+	if major != 1 {
+		return 0, 0, fmt.Errorf("%w: %q", ErrUnsupportedVersion, version)
+	}
+	return major, minor, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parseContentLength parses a Content-Length value, which may only consist of
+// digits. Atoi alone would also accept a sign, which a proxy in front of us
+// might not.
+func parseContentLength(value string) (int, error) {
+	if value == "" {
+		return 0, strconv.ErrSyntax
+	}
+	for i := 0; i < len(value); i++ {
+		if !isDigit(value[i]) {
+			return 0, strconv.ErrSyntax
+		}
+	}
+	return strconv.Atoi(value)
+}
+
+// bodyState picks how the body is framed once the headers are parsed. A
+// request with both Content-Length and Transfer-Encoding is rejected, since
+// a proxy in front of us might frame it differently (request smuggling).
+func (r *Request) bodyState() (RequestState, error) {
+	length, hasLength := r.Headers.Get("Content-Length"), r.Headers.Has("Content-Length")
+	encoding, hasEncoding := r.Headers.Get("Transfer-Encoding"), r.Headers.Has("Transfer-Encoding")
+	switch {
+	case hasLength && hasEncoding:
+		return 0, ErrConflictingFraming
+	case hasEncoding:
+		if !strings.EqualFold(strings.TrimSpace(encoding), "chunked") {
+			return 0, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, encoding)
+		}
+		return parsingChunkSize, nil
+	case hasLength:
+		contentLength, err := parseContentLength(length)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, length)
+		}
+		if exceeds(contentLength, r.limits.MaxBodyBytes) {
+			return 0, ErrBodyTooLarge
+		}
+		r.contentLength = contentLength
+		if contentLength == 0 {
+			return done, nil
+		}
+		return parsingBody, nil
+	default:
+		// If no Content-Length header is present, then there is no body.
+		return done, nil
+	}
+}
+
+// parseField parses one header or trailer field line into h
+func (r *Request) parseField(h *headers.Headers, data []byte) (int, bool, error) {
+	if r.lenient {
+		return h.ParseLenient(data)
+	}
+	return h.Parse(data)
+}
+
+// countFieldLine applies the header limits after a header or trailer parsing
+// step that consumed n of the buffered data
+func (r *Request) countFieldLine(data []byte, n int, finished bool) error {
+	if n == 0 {
+		// Incomplete line, make sure waiting for the rest can't exceed the limit
+		if exceeds(r.headerBytes+len(data), r.limits.MaxHeaderBytes) {
+			return ErrHeaderTooLarge
+		}
+		return nil
+	}
+	if finished {
+		return nil
+	}
+	r.headerBytes += n
+	r.headerCount++
+	if exceeds(r.headerBytes, r.limits.MaxHeaderBytes) || exceeds(r.headerCount, r.limits.MaxHeaderCount) {
+		return ErrHeaderTooLarge
+	}
+	return nil
+}
+
+// copyBody copies up to limit bytes of body data to the body reader's
+// destination and returns how many were copied
+func (r *Request) copyBody(data []byte, limit int) int {
+	n := copy(r.out[r.outN:], data[:min(limit, len(data))])
+	r.outN += n
+	return n
+}
+
+// parseChunkSize parses a chunk size line without its CRLF, ignoring any
+// chunk extensions (";name=value")
+func parseChunkSize(line []byte) (int, error) {
+	sizeField, _, _ := bytes.Cut(line, []byte(";"))
+	sizeField = bytes.TrimRight(sizeField, " \t")
+	if len(sizeField) == 0 {
+		return 0, fmt.Errorf("%w: missing chunk size", ErrInvalidChunk)
+	}
+	size, err := strconv.ParseUint(string(sizeField), 16, 64)
+	if err != nil || size > maxChunkSize {
+		return 0, fmt.Errorf("%w: invalid chunk size %q", ErrInvalidChunk, sizeField)
+	}
+	return int(size), nil
+}
+
 // parse parses the request line and headers and sets the state to done
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesRead := 0
@@ -149,53 +437,101 @@ func (r *Request) parse(data []byte) (int, error) {
 			}
 	
 			if numBytesPerRead == 0 {
+				if exceeds(len(data), r.limits.MaxRequestLineBytes) {
+					return 0, ErrRequestLineTooLong
+				}
 				return 0, nil
 			}
+			if exceeds(numBytesPerRead-2, r.limits.MaxRequestLineBytes) {
+				return 0, ErrRequestLineTooLong
+			}
 	
 			r.RequestLine = *reqLine
+			if err := r.parseTarget(); err != nil {
+				return 0, err
+			}
 			r.state = parsingHeaders
 			totalBytesRead += numBytesPerRead
 		case parsingHeaders:
-			numBytesPerRead, finished, err := r.Headers.Parse(data[totalBytesRead:])
+			numBytesPerRead, finished, err := r.parseField(&r.Headers, data[totalBytesRead:])
 			if err != nil {
 				return 0, err
 			}
+			if err := r.countFieldLine(data, numBytesPerRead, finished); err != nil {
+				return 0, err
+			}
 	
 			if finished {
-        // If no Content-Length header is present, then there is no body.
-        if _, ok := r.Headers["content-length"]; !ok {
-          r.state = done
-        } else {
-          r.state = parsingBody
-        }
+				state, err := r.bodyState()
+				if err != nil {
+					return 0, err
+				}
+				r.state = state
+				// HTTP/1.0 clients don't wait for 100 Continue
+				r.expectContinue = state != done && r.RequestLine.ProtoAtLeast(1, 1) && r.Headers.HasToken("Expect", "100-continue")
 			}
 	
 			totalBytesRead += numBytesPerRead
 		case parsingBody:
-			length, ok := r.Headers["content-length"]
-			if !ok {
+			// Only take what belongs to this request, anything after it is the
+			// start of the next request on the connection.
+			n := r.copyBody(data, r.contentLength-r.bodyReadLength)
+			r.bodyReadLength += n
+			if r.contentLength == r.bodyReadLength {
 				r.state = done
-				return len(data), nil
 			}
-			contentLength, err := strconv.Atoi(length)
+			return n, nil
+		case parsingChunkSize:
+			idx := bytes.Index(data, []byte("\r\n"))
+			if idx == -1 {
+				if len(data) > maxChunkLineBytes {
+					return 0, fmt.Errorf("%w: chunk size line too long", ErrInvalidChunk)
+				}
+				return 0, nil
+			}
+			size, err := parseChunkSize(data[:idx])
 			if err != nil {
 				return 0, err
 			}
-			if contentLength == 0 {
-				r.state = done
-				return len(data), nil
+			if exceeds(r.bodyReadLength+size, r.limits.MaxBodyBytes) {
+				return 0, ErrBodyTooLarge
 			}
-			r.Body = append(r.Body, data...)
-			r.bodyReadLength += len(data)
-
-			if contentLength < r.bodyReadLength {
-				return 0, fmt.Errorf("error: content length is less than body length")
+			if size == 0 {
+				r.state = parsingTrailers
+			} else {
+				r.chunkRemaining = size
+				r.state = parsingChunkData
 			}
-			if contentLength == r.bodyReadLength {
+			return idx + 2, nil
+		case parsingChunkData:
+			n := r.copyBody(data, r.chunkRemaining)
+			r.chunkRemaining -= n
+			r.bodyReadLength += n
+			if r.chunkRemaining == 0 {
+				r.state = parsingChunkDataEnd
+			}
+			return n, nil
+		case parsingChunkDataEnd:
+			if len(data) < 2 {
+				return 0, nil
+			}
+			if data[0] != '\r' || data[1] != '\n' {
+				return 0, fmt.Errorf("%w: missing CRLF after chunk data", ErrInvalidChunk)
+			}
+			r.state = parsingChunkSize
+			return 2, nil
+		case parsingTrailers:
+			n, finished, err := r.parseField(&r.Trailers, data)
+			if err != nil {
+				return 0, err
+			}
+			if err := r.countFieldLine(data, n, finished); err != nil {
+				return 0, err
+			}
+			if finished {
 				r.state = done
 			}
-
-			return len(data), nil
+			return n, nil
 		case done:
 			return 0, fmt.Errorf("error: trying to read data in a done state")
 		default:
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/isotronic/httpfromtcp/internal/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -79,9 +80,21 @@ func TestRequestLineParse(t *testing.T) {
 	_, err = RequestFromReader(strings.NewReader("/coffee POST HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
 	require.Error(t, err)
 
-	// Test: Invalid http version
-	_, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/1.0\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
-	require.Error(t, err)
+	// Test: HTTP/1.0 request line
+	r, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/1.0\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.Equal(t, 1, r.RequestLine.Major)
+	assert.Equal(t, 0, r.RequestLine.Minor)
+	assert.False(t, r.RequestLine.ProtoAtLeast(1, 1))
+
+	// Test: Unsupported http version
+	_, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/2.0\r\nHost: localhost:42069\r\n\r\n"))
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// Test: Malformed http version
+	_, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/1\r\nHost: localhost:42069\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidRequestLine)
 }
 
 func TestHeadersParse(t *testing.T) {
@@ -93,9 +106,9 @@ func TestHeadersParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", r.Headers.Get("host"))
+	assert.Equal(t, "curl/7.81.0", r.Headers.Get("user-agent"))
+	assert.Equal(t, "*/*", r.Headers.Get("accept"))
 
 	// Test: Empty Headers
 	reader = &chunkReader{
@@ -105,9 +118,9 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", r.Headers["host"])
-	assert.Equal(t, "", r.Headers["user-agent"])
-	assert.Equal(t, "", r.Headers["accept"])
+	assert.Equal(t, "", r.Headers.Get("host"))
+	assert.Equal(t, "", r.Headers.Get("user-agent"))
+	assert.Equal(t, "", r.Headers.Get("accept"))
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -125,7 +138,7 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, localhost:42070", r.Headers["host"])
+	assert.Equal(t, "localhost:42069, localhost:42070", r.Headers.Get("host"))
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -135,7 +148,7 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, localhost:42070", r.Headers["host"])
+	assert.Equal(t, "localhost:42069, localhost:42070", r.Headers.Get("host"))
 
 	// Test: Missing End of Headers
 	reader = &chunkReader{
@@ -145,7 +158,7 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
+	assert.Equal(t, "localhost:42069", r.Headers.Get("host"))
 }
 
 func TestBodyParse(t *testing.T) {
@@ -212,3 +225,374 @@ func TestBodyParse(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, r)
 }
+
+func TestReaderMultipleRequests(t *testing.T) {
+	// Test: Pipelined requests on one connection
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /coffee HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
+
+	// Test: Connection closed between requests
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection closed in the middle of the request line
+	_, err = RequestFromReader(strings.NewReader("GET /cof"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: Chunked body with extensions and trailers
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5;name=value\r\n" +
+			"hello\r\n" +
+			"7 \r\n" +
+			" world!\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "abc123", r.Trailers.Get("x-checksum"))
+
+	// Test: Chunked request followed by a pipelined request
+	multi := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"A\r\n" +
+			"0123456789\r\n" +
+			"0\r\n" +
+			"\r\n" +
+			"GET / HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	})
+	r, err = multi.ReadRequest()
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(body))
+	r, err = multi.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+
+	// Test: Chunked body cut short
+	_, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"A\r\n" +
+		"01234"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Invalid chunk size
+	_, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"xyz\r\n" +
+		"0\r\n\r\n"))
+	require.Error(t, err)
+
+	// Test: Chunk data longer than its size
+	_, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"2\r\n" +
+		"abc\r\n" +
+		"0\r\n\r\n"))
+	require.Error(t, err)
+
+	// Test: Both Content-Length and Transfer-Encoding
+	_, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+		"Content-Length: 5\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"0\r\n\r\n"))
+	require.Error(t, err)
+
+	// Test: Unsupported transfer coding
+	_, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+		"Transfer-Encoding: gzip\r\n" +
+		"\r\n"))
+	require.Error(t, err)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: Body is read lazily in pieces
+	reader := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 26\r\n" +
+			"\r\n" +
+			"abcdefghijklmnopqrstuvwxyz" +
+			"GET /next HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Nil(t, r.Body)
+	buf := make([]byte, 10)
+	n, err := io.ReadFull(r.BodyReader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghij", string(buf[:n]))
+
+	// Test: Unread body is skipped before the next request
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	n, err = r.BodyReader.Read(buf)
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Invalid Content-Length is rejected with the headers
+	_, err = NewReader(strings.NewReader("POST /upload HTTP/1.1\r\n" +
+		"Content-Length: -1\r\n" +
+		"\r\n")).ReadRequest()
+	require.Error(t, err)
+
+	// Test: Too much unread body to discard
+	reader = NewReader(io.MultiReader(
+		strings.NewReader("POST /upload HTTP/1.1\r\nContent-Length: 1000000\r\n\r\n"),
+		strings.NewReader(strings.Repeat("x", 1000000)),
+	))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.BodyReader.Close(), ErrBodyNotDrained)
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyNotDrained)
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 20,
+		MaxHeaderBytes:      40,
+		MaxHeaderCount:      2,
+		MaxBodyBytes:        5,
+	}
+	read := func(data string) (*Request, error) {
+		reader := NewReader(&chunkReader{data: data, numBytesPerRead: 3})
+		reader.Limits = limits
+		r, err := reader.ReadRequest()
+		if err != nil {
+			return r, err
+		}
+		_, err = r.ReadBody()
+		return r, err
+	}
+
+	// Test: Within all limits
+	_, err := read("POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+
+	// Test: Request line too long
+	_, err = read("GET /" + strings.Repeat("a", 30) + " HTTP/1.1\r\n\r\n")
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Request line too long without ever ending
+	_, err = read("GET /" + strings.Repeat("a", 100))
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Too many header fields
+	_, err = read("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n")
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Header field too large
+	_, err = read("GET / HTTP/1.1\r\nCookie: " + strings.Repeat("x", 100) + "\r\n\r\n")
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Content-Length over the limit is rejected with the headers
+	reader := NewReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 6\r\n\r\nhello!"))
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body over the limit
+	_, err = read("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n")
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Zero limits mean no limit
+	reader = NewReader(strings.NewReader("GET /" + strings.Repeat("a", 10000) + " HTTP/1.1\r\n\r\n"))
+	reader.Limits = Limits{}
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		err    error
+		offset int64
+		state  string
+	}{
+		{"invalid method", "get / HTTP/1.1\r\n\r\n", ErrInvalidMethod, 0, "request line"},
+		{"invalid request line", "GET /\r\n\r\n", ErrInvalidRequestLine, 0, "request line"},
+		{"unsupported version", "GET / HTTP/2.0\r\n\r\n", ErrUnsupportedVersion, 0, "request line"},
+		{"invalid header name", "GET / HTTP/1.1\r\nHost: a\r\nB@d: 1\r\n\r\n", headers.ErrInvalidFieldName, 25, "headers"},
+		{"missing colon", "GET / HTTP/1.1\r\nHost\r\n\r\n", headers.ErrMalformedFieldLine, 16, "headers"},
+		{"invalid content length", "POST / HTTP/1.1\r\nContent-Length: abc\r\n\r\n", ErrInvalidContentLength, 38, "headers"},
+		{"signed content length", "POST / HTTP/1.1\r\nContent-Length: +3\r\n\r\nabc", ErrInvalidContentLength, 37, "headers"},
+		{"negative zero content length", "POST / HTTP/1.1\r\nContent-Length: -0\r\n\r\n", ErrInvalidContentLength, 37, "headers"},
+		{"conflicting framing", "POST / HTTP/1.1\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n", ErrConflictingFraming, 64, "headers"},
+		{"unsupported encoding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", ErrUnsupportedEncoding, 42, "headers"},
+		{"invalid chunk", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", ErrInvalidChunk, 47, "chunk size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := RequestFromReader(strings.NewReader(tt.data))
+			require.ErrorIs(t, err, tt.err)
+			var parseErr *ParseError
+			require.ErrorAs(t, err, &parseErr)
+			assert.Equal(t, tt.offset, parseErr.Offset)
+			assert.Equal(t, tt.state, parseErr.State.String())
+		})
+	}
+}
+
+func TestRequestTarget(t *testing.T) {
+	parse := func(method, target string) (*Request, error) {
+		return RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	}
+
+	// Test: Origin form with a query
+	r, err := parse("GET", "/caf%C3%A9/menu?q=1&q=2&lang=en%20gb")
+	require.NoError(t, err)
+	assert.Equal(t, OriginForm, r.TargetForm)
+	assert.Equal(t, "/café/menu", r.Path)
+	assert.Equal(t, "/caf%C3%A9/menu", r.RawPath)
+	assert.Equal(t, "q=1&q=2&lang=en%20gb", r.RawQuery)
+	assert.Equal(t, []string{"1", "2"}, r.Query["q"])
+	assert.Equal(t, "en gb", r.Query.Get("lang"))
+	assert.Equal(t, "", r.Host)
+
+	// Test: Absolute form
+	r, err = parse("GET", "http://example.com:8080/a%2Fb?x=y")
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, r.TargetForm)
+	assert.Equal(t, "example.com:8080", r.Host)
+	assert.Equal(t, "/a/b", r.Path)
+	assert.Equal(t, "/a%2Fb", r.RawPath)
+	assert.Equal(t, "y", r.Query.Get("x"))
+
+	// Test: Absolute form without a path
+	r, err = parse("GET", "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "/", r.Path)
+
+	// Test: Authority form for CONNECT
+	r, err = parse("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, r.TargetForm)
+	assert.Equal(t, "example.com:443", r.Host)
+	assert.Equal(t, "", r.Path)
+
+	// Test: Asterisk form for OPTIONS
+	r, err = parse("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, r.TargetForm)
+	assert.Equal(t, "*", r.Path)
+
+	// Test: Invalid targets
+	for _, tt := range []struct{ method, target string }{
+		{"GET", "/a%zzb"},
+		{"GET", "/a?b=%4"},
+		{"GET", "/a#frag"},
+		{"GET", "*"},
+		{"GET", "ftp://example.com/"},
+		{"GET", "example.com"},
+		{"CONNECT", "/path"},
+		{"CONNECT", "example.com"},
+	} {
+		_, err = parse(tt.method, tt.target)
+		assert.ErrorIs(t, err, ErrInvalidTarget, "%s %s", tt.method, tt.target)
+	}
+}
+
+func TestLenientHeaders(t *testing.T) {
+	data := "POST / HTTP/1.1\r\n" +
+		"Host: localhost\n" +
+		"X-Long: first\r\n second\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"3\r\nabc\r\n0\r\n" +
+		"X-Checksum: a\r\n\tb\r\n" +
+		"\r\n"
+
+	// Test: Bare LF and folding are rejected by default
+	_, err := RequestFromReader(strings.NewReader(data))
+	require.ErrorIs(t, err, headers.ErrMalformedFieldLine)
+
+	// Test: Lenient reader accepts them in headers and trailers
+	reader := NewReader(&chunkReader{data: data, numBytesPerRead: 3})
+	reader.Lenient = true
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "localhost", r.Headers.Get("Host"))
+	assert.Equal(t, "first second", r.Headers.Get("X-Long"))
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(body))
+	assert.Equal(t, "a b", r.Trailers.Get("X-Checksum"))
+}
+
+func TestExpectContinue(t *testing.T) {
+	data := "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\nhello"
+
+	// Test: Continue is sent once, on the first read
+	reader := NewReader(strings.NewReader(data))
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+	sent := 0
+	r.SetContinue(func() error {
+		sent++
+		return nil
+	})
+	assert.Equal(t, 0, sent)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 1, sent)
+	assert.False(t, r.ExpectsContinue())
+
+	// Test: Body that was never asked for can't be skipped
+	reader = NewReader(strings.NewReader(data))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.BodyReader.Close(), ErrBodyNotDrained)
+
+	// Test: HTTP/1.0 and requests without a body don't wait
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.0\r\nContent-Length: 0\r\nExpect: 100-continue\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+	reader = NewReader(strings.NewReader("POST / HTTP/1.0\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\nhello"))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+}
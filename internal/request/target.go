@@ -0,0 +1,111 @@
+package request
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// TargetForm is the form of the request target (RFC 9112 section 3.2)
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path with an optional query, e.g.
+	// "/where?q=now". Most requests use this form.
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a full URI, e.g. "http://example.com/where?q=now", as
+	// sent to proxies
+	AbsoluteForm
+	// AuthorityForm is a host and port, e.g. "example.com:443", and is only
+	// used by CONNECT
+	AuthorityForm
+	// AsteriskForm is "*" and is only used by a server-wide OPTIONS request
+	AsteriskForm
+)
+
+func (f TargetForm) String() string {
+	switch f {
+	case OriginForm:
+		return "origin-form"
+	case AbsoluteForm:
+		return "absolute-form"
+	case AuthorityForm:
+		return "authority-form"
+	case AsteriskForm:
+		return "asterisk-form"
+	default:
+		return fmt.Sprintf("TargetForm(%d)", int(f))
+	}
+}
+
+// parseTarget fills in the parsed fields of r from RequestLine.RequestTarget
+func (r *Request) parseTarget() error {
+	target := r.RequestLine.RequestTarget
+	if target == "" || !validTargetChars(target) {
+		return fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+	}
+
+	switch {
+	case r.RequestLine.Method == "CONNECT":
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" || port == "" {
+			return fmt.Errorf("%w: CONNECT needs host:port, got %q", ErrInvalidTarget, target)
+		}
+		r.TargetForm = AuthorityForm
+		r.Host = target
+		return nil
+	case target == "*":
+		if r.RequestLine.Method != "OPTIONS" {
+			return fmt.Errorf("%w: %q is only allowed for OPTIONS", ErrInvalidTarget, target)
+		}
+		r.TargetForm = AsteriskForm
+		r.Path, r.RawPath = "*", "*"
+		return nil
+	case strings.HasPrefix(target, "/"):
+		r.TargetForm = OriginForm
+		r.RawPath, r.RawQuery, _ = strings.Cut(target, "?")
+	default:
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Opaque != "" {
+			return fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+		}
+		r.TargetForm = AbsoluteForm
+		r.Host = u.Host
+		r.RawPath, r.RawQuery = u.EscapedPath(), u.RawQuery
+		if r.RawPath == "" {
+			r.RawPath = "/"
+		}
+	}
+
+	path, err := url.PathUnescape(r.RawPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	r.Path = path
+	// ParseQuery has already checked the escapes through validTargetChars,
+	// its only other error is for a ";" separator, whose pair it skips
+	r.Query, _ = url.ParseQuery(r.RawQuery)
+	return nil
+}
+
+// validTargetChars reports whether target only contains visible ASCII
+// characters other than "#" and every "%" starts a valid escape
+func validTargetChars(target string) bool {
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+		switch {
+		case c <= ' ' || c >= 0x7f || c == '#':
+			return false
+		case c == '%':
+			if i+2 >= len(target) || !isHex(target[i+1]) || !isHex(target[i+2]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,140 @@
+package response
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// bufferThreshold is how much Write buffers before the headers are written.
+// A response that ends within it gets a Content-Length, a longer one is sent
+// with chunked encoding.
+const bufferThreshold = 4096
+
+// Write writes p as part of the body, so handlers can use the Writer as an
+// io.Writer and call it any number of times. If the status line hasn't been
+// written, 200 OK is. If the headers haven't been written, the ones set
+// through Header() are written once the body is known to be longer than
+// bufferThreshold or the handler returns, with a Content-Length or chunked
+// encoding added unless Header() already has one. Writing past the declared
+// Content-Length fails with ErrContentLength, whether or not the headers have
+// been written.
+func (w *Writer) Write(p []byte) (int, error) {
+	switch w.state {
+	case writingStatusLine:
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return 0, err
+		}
+		fallthrough
+	case writingHeaders:
+		if bodyless(w.status) && len(p) > 0 {
+			return 0, ErrBodyNotAllowed
+		}
+		if length := w.declaredLength(); length >= 0 && int64(len(w.buf)+len(p)) > length {
+			return 0, ErrContentLength
+		}
+		w.buf = append(w.buf, p...)
+		if len(w.buf) <= bufferThreshold {
+			return len(p), nil
+		}
+		if err := w.writeBuffered(false); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	case writingBody:
+		return w.writeBody(p)
+	default:
+		return 0, fmt.Errorf("error: cannot write body after it was ended")
+	}
+}
+
+// Finish completes the response once the handler has returned. Whatever
+// part of the response the handler didn't write is written: the status line,
+// the headers and buffered body, and the end of a chunked body with the
+// trailers set through Trailer(). If the body is shorter than its
+// Content-Length it returns ErrShortBody and the connection must not be
+// reused. The response is flushed in either case.
+func (w *Writer) Finish() error {
+	err := w.finish()
+	if flushErr := w.writer.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func (w *Writer) finish() error {
+	switch w.state {
+	case writingStatusLine:
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return err
+		}
+		fallthrough
+	case writingHeaders:
+		if err := w.writeBuffered(true); err != nil {
+			return err
+		}
+		fallthrough
+	case writingBody, writingTrailers:
+		if w.chunked {
+			return w.WriteTrailers(nil)
+		}
+		w.state = responseDone
+		if w.contentLength >= 0 && w.written < w.contentLength {
+			// The client would wait for the rest of the body or read the
+			// next response as part of it
+			w.keepAlive = false
+			return fmt.Errorf("%w: wrote %d of %d bytes", ErrShortBody, w.written, w.contentLength)
+		}
+	}
+	return nil
+}
+
+// writeBuffered writes the headers and the buffered body. When final is set
+// the buffer holds the whole body, so its length is announced.
+func (w *Writer) writeBuffered(final bool) error {
+	h := w.Header()
+	if !bodyless(w.status) && !h.Has("Content-Length") && !h.HasToken("Transfer-Encoding", "chunked") {
+		// Trailers can only be sent with chunked encoding
+		if final && !h.Has("Trailer") {
+			h.Set("Content-Length", strconv.Itoa(len(w.buf)))
+		} else {
+			h.Set("Transfer-Encoding", "chunked")
+		}
+	}
+	if err := w.WriteHeaders(nil); err != nil {
+		return err
+	}
+	buf := w.buf
+	w.buf = nil
+	_, err := w.writeBody(buf)
+	return err
+}
+
+// declaredLength returns the Content-Length set through Header() that the
+// body will be checked against, or -1 if there is none
+func (w *Writer) declaredLength() int64 {
+	h := w.Header()
+	if w.head || !h.Has("Content-Length") || h.HasToken("Transfer-Encoding", "chunked") {
+		return -1
+	}
+	length, err := parseContentLength(h.Get("Content-Length"))
+	if err != nil {
+		// Reported by WriteHeaders
+		return -1
+	}
+	return length
+}
+
+// writeBody writes p framed the way the headers announced
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if len(p) == 0 {
+		// An empty chunk would end the body
+		return 0, nil
+	}
+	if w.chunked {
+		if _, err := w.WriteChunkedBody(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.WriteBody(p)
+}
@@ -1,17 +1,78 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/isotronic/httpfromtcp/internal/headers"
 )
 
 type Writer struct {
-	writer io.Writer
-	state  writerState
+	// writer buffers the response so the status line, headers and start of
+	// the body go out together. It comes from bufferPool and goes back on
+	// Release.
+	writer    *bufio.Writer
+	state     writerState
+	keepAlive bool
+	status    StatusCode
+	reason    string
+	header    headers.Headers
+
+	// http10 is set for HTTP/1.0 clients, which don't understand chunked
+	// encoding. Chunked bodies are then written as is and end when the
+	// connection is closed.
+	http10    bool
+	unchunked bool
+
+	// head is set for responses to HEAD requests, which have the headers
+	// of a GET response but no body
+	head bool
+
+	// beforeHeaders is called right before the headers are written
+	beforeHeaders func()
+
+	// chunked is set once headers announcing chunked encoding are written,
+	// so Write frames the body as chunks
+	chunked bool
+	// buf holds what Write got before the headers were written
+	buf []byte
+
+	// trailer holds trailers set through Trailer(), and announced the names
+	// listed in the Trailer header
+	trailer   headers.Headers
+	announced []string
+
+	// contentLength is the declared Content-Length, or -1 if the body isn't
+	// framed by one, and written how much of the body was written
+	contentLength int64
+	written       int64
+}
+
+// ErrContentLength is returned when a handler writes more body than the
+// Content-Length it declared
+var ErrContentLength = errors.New("wrote more than the declared Content-Length")
+
+// ErrBodyNotAllowed is returned when a handler writes a body for a status
+// that can't have one: 1xx, 204 No Content and 304 Not Modified
+var ErrBodyNotAllowed = errors.New("response status does not allow a body")
+
+// ErrShortBody is returned by Finish when the body is shorter than the
+// declared Content-Length
+var ErrShortBody = errors.New("wrote less than the declared Content-Length")
+
+// bufferSize is the size of the buffer responses are written through. Small
+// responses fit whole and are sent with a single write.
+const bufferSize = 4096
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return bufio.NewWriterSize(nil, bufferSize)
+	},
 }
 
 type writerState int
@@ -21,134 +82,474 @@ const (
 	writingHeaders
 	writingBody
 	writingTrailers
+	responseDone
 )
 
-type StatusCode int
-
-const (
-	StatusOK									StatusCode = 200
-	StatusBadRequest					StatusCode = 400
-	StatusInternalServerError	StatusCode = 500
-)
-
-// NewWriter creates a new Writer with the given io.Writer
+// NewWriter creates a new Writer with the given io.Writer. Writes are
+// buffered until the buffer is full, a chunk is written, or Flush or Finish
+// is called.
 func NewWriter(w io.Writer) *Writer {
+	bw := bufferPool.Get().(*bufio.Writer)
+	bw.Reset(w)
 	return &Writer{
-			writer: w,
+			writer: bw,
 			state: writingStatusLine,
+			contentLength: -1,
 	}
 }
 
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.NewHeaders()
 	h.Add("Content-Length", strconv.Itoa(contentLen))
-	h.Add("Connection", "close")
 	h.Add("Content-Type", "text/plain")
 	return h
 }
 
+// SetKeepAlive tells the writer whether the server intends to reuse the
+// connection for another request once this response is complete. Writers
+// start out with keep-alive disabled and send "Connection: close".
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// SetRequestVersion tells the writer which HTTP version the client used so
+// the response only uses features it understands
+func (w *Writer) SetRequestVersion(major, minor int) {
+	w.http10 = major == 1 && minor == 0
+}
+
+// SetRequestMethod tells the writer the method of the request. For HEAD the
+// headers are written as given, Content-Length included, but body writes are
+// discarded.
+func (w *Writer) SetRequestMethod(method string) {
+	w.head = method == "HEAD"
+}
+
+// KeepAlive reports whether the connection can be reused after the response.
+// This is false if the handler asked for the connection to be closed, wrote a
+// response the client can't frame without reading to EOF, or the headers
+// weren't written.
+func (w *Writer) KeepAlive() bool {
+	return w.keepAlive && w.state != writingStatusLine && w.state != writingHeaders
+}
+
+// Header returns headers that are added to the response by WriteHeaders
+// unless the handler passes its own value for the same key. Middleware uses
+// this to set headers without touching every handler.
+func (w *Writer) Header() *headers.Headers {
+	return &w.header
+}
+
+// Status returns the status code written so far, or 0 if the status line has
+// not been written yet
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// WriteStatusLine writes the status line with the registered reason phrase
+// for statusCode. Unregistered codes are written with an empty reason. The
+// line is held back until WriteHeaders, so nothing is sent if the headers
+// turn out to be invalid.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineWithReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineWithReason writes the status line with a custom reason
+// phrase. The code must have three digits and the reason may only contain
+// visible characters, spaces and tabs.
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reason string) error {
 	if w.state != writingStatusLine {
 		return fmt.Errorf("error: cannot write status line")
 	}
-	defer func() {
-		w.state = writingHeaders
-	}()
-	switch statusCode {
-	case StatusOK:
-		_, err := w.writer.Write([]byte("HTTP/1.1 200 OK\r\n"))
-		if err != nil {
-			return err
-		}
-		return nil
-	case StatusBadRequest:
-		_, err := w.writer.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
-		if err != nil {
-			return err
-		}
-		return nil
-	case StatusInternalServerError:
-		_, err := w.writer.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n"))
-		if err != nil {
-			return err
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("error: invalid status code: %d", statusCode)
+	}
+	for _, c := range []byte(reason) {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return fmt.Errorf("error: invalid character in reason phrase: %q", reason)
 		}
+	}
+	w.state = writingHeaders
+	w.status = statusCode
+	w.reason = reason
+	return nil
+}
+
+// HeadersWritten reports whether the headers have been written, after which
+// the response can no longer be replaced. Until then the status line is held
+// back and Reset can discard it.
+func (w *Writer) HeadersWritten() bool {
+	return w.state != writingStatusLine && w.state != writingHeaders
+}
+
+// Reset discards the status line and the body Write buffered, so a different
+// response can be written, e.g. an error. Headers set through Header() and
+// Trailer() are kept. It fails once the headers have been written.
+func (w *Writer) Reset() error {
+	if w.HeadersWritten() {
+		return fmt.Errorf("error: cannot reset response after writing headers")
+	}
+	w.state = writingStatusLine
+	w.status = 0
+	w.reason = ""
+	w.buf = nil
+	return nil
+}
+
+func (w *Writer) writeStatusLine(statusCode StatusCode, reason string) error {
+	w.writer.WriteString("HTTP/1.1 ")
+	w.writer.WriteString(strconv.Itoa(int(statusCode)))
+	w.writer.WriteByte(' ')
+	w.writer.WriteString(reason)
+	// Errors stick to the bufio.Writer, so the last write returns any of them
+	_, err := w.writer.WriteString("\r\n")
+	return err
+}
+
+// writeFields writes field lines followed by the empty line ending the block
+func (w *Writer) writeFields(fields headers.Headers) error {
+	for _, f := range fields {
+		w.writer.WriteString(f.Name)
+		w.writer.WriteString(": ")
+		w.writer.WriteString(f.Value)
+		w.writer.WriteString("\r\n")
+	}
+	_, err := w.writer.WriteString("\r\n")
+	return err
+}
+
+// SetBeforeHeaders sets a function that is called right before the headers
+// are written. The server uses it to turn keep-alive off when the state of
+// the request means the connection can't be reused.
+func (w *Writer) SetBeforeHeaders(fn func()) {
+	w.beforeHeaders = fn
+}
+
+// WriteInterim writes an informational (1xx) response with the given
+// headers, e.g. 100 Continue or 103 Early Hints, ahead of the final response.
+// It can be called several times before the headers are written. HTTP/1.0
+// clients don't understand interim responses, so nothing is written to them.
+// The response is flushed right away since the client may be waiting for it.
+func (w *Writer) WriteInterim(statusCode StatusCode, h headers.Headers) error {
+	if w.HeadersWritten() {
+		return fmt.Errorf("error: cannot write interim response after the headers")
+	}
+	// 101 Switching Protocols ends HTTP on the connection, which the
+	// writer doesn't support
+	if statusCode < 100 || statusCode > 199 || statusCode == StatusSwitchingProtocols {
+		return fmt.Errorf("error: invalid interim status code: %d", statusCode)
+	}
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	if w.http10 {
 		return nil
-	default:
-		return nil
 	}
+
+	w.writeStatusLine(statusCode, StatusText(statusCode))
+	if err := w.writeFields(h); err != nil {
+		return err
+	}
+	return w.writer.Flush()
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.state != writingHeaders {
 		return fmt.Errorf("error: cannot write headers before writing status line")
 	}
+
+	if w.beforeHeaders != nil {
+		w.beforeHeaders()
+	}
+
+	// Headers passed by the handler win over ones set through Header()
+	fields := h.Clone()
+	for _, f := range w.header {
+		if !h.Has(f.Name) {
+			fields.Add(f.Name, f.Value)
+		}
+	}
+	// A CR or LF in a value echoed from the request would let the client
+	// split the response, so nothing is written if any field is invalid
+	if err := fields.Validate(); err != nil {
+		return err
+	}
+	noBody := bodyless(w.status)
+	if noBody {
+		// These responses end with the headers. Only a 304 may carry the
+		// Content-Length a 200 would have had.
+		fields.Del("Transfer-Encoding")
+		fields.Del("Trailer")
+		if w.status != StatusNotModified {
+			fields.Del("Content-Length")
+		}
+	}
+	// A client that goes by Content-Length would read the chunks as the body
+	// and the rest as the next response, so chunked encoding wins
+	if fields.HasToken("Transfer-Encoding", "chunked") {
+		fields.Del("Content-Length")
+	}
+	// The body written is checked against the declared length
+	if fields.Has("Content-Length") {
+		length, err := parseContentLength(fields.Get("Content-Length"))
+		if err != nil {
+			return fmt.Errorf("error: invalid Content-Length: %q", fields.Get("Content-Length"))
+		}
+		if !w.head && !noBody {
+			w.contentLength = length
+		}
+	}
+	var announced []string
+	for _, name := range strings.Split(fields.Get("Trailer"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if forbiddenTrailer(name) {
+			return fmt.Errorf("error: %q cannot be sent as a trailer", name)
+		}
+		announced = append(announced, name)
+	}
 	defer func() {
 		w.state = writingBody
 	}()
-	responseHeaders := ""
-	for header := range headers {
-		responseHeaders += header + ": " + headers[header] + "\r\n"
+
+	w.chunked = fields.HasToken("Transfer-Encoding", "chunked")
+	w.announced = announced
+
+	// An HTTP/1.0 client can't decode chunks, so the body is sent raw and
+	// framed by closing the connection instead
+	if w.http10 && w.chunked {
+		fields.Del("Transfer-Encoding")
+		fields.Del("Trailer")
+		w.unchunked = true
 	}
-	_, err := w.writer.Write([]byte(responseHeaders + "\r\n"))
-	if err != nil {
-		return err
+
+	// Without a Content-Length or chunked encoding the client can only find
+	// the end of the body by reading until the connection is closed. A
+	// response to HEAD or with a bodyless status never has a body, so it
+	// doesn't matter there.
+	if fields.HasToken("Connection", "close") || (!w.head && !noBody && !fields.Has("Content-Length") && !fields.HasToken("Transfer-Encoding", "chunked")) {
+		w.keepAlive = false
 	}
 
-	return nil
+	if !w.keepAlive || w.http10 {
+		fields.Del("Connection")
+	}
+	if !w.keepAlive {
+		fields.Add("Connection", "close")
+	} else if w.http10 {
+		// HTTP/1.0 connections close by default
+		fields.Add("Connection", "keep-alive")
+	}
+	w.writeStatusLine(w.status, w.reason)
+	return w.writeFields(fields)
 }
 
+// Trailer returns trailers that are sent after a chunked body, merged with
+// the ones passed to WriteTrailers. Handlers set them while or after writing
+// the body, e.g. a checksum, and they are written when the response is
+// finished. Each one must be announced in the Trailer header.
+func (w *Writer) Trailer() *headers.Headers {
+	return &w.trailer
+}
+
+// WriteTrailers ends a chunked body, if WriteChunkedBodyDone wasn't called,
+// and writes the trailers in h and Trailer(). It fails for responses that
+// aren't chunked, for trailers not announced in the Trailer header and for
+// fields that can't be trailers, such as Content-Length. For
+// HTTP/1.0 clients and HEAD requests the trailers are dropped.
 func (w *Writer) WriteTrailers(h headers.Headers) error {
-	if w.state != writingTrailers {
+	if w.state != writingBody && w.state != writingTrailers {
 		return fmt.Errorf("error: cannot write trailers before writing body")
 	}
-	responseTrailers := ""
-	for header := range h {
-		responseTrailers += header + ": " + h[header] + "\r\n"
+	if !w.chunked {
+		return fmt.Errorf("error: cannot write trailers without chunked encoding")
+	}
+
+	trailers := h.Clone()
+	for _, f := range w.trailer {
+		if !h.Has(f.Name) {
+			trailers.Add(f.Name, f.Value)
+		}
 	}
-	_, err := w.writer.Write([]byte(responseTrailers + "\r\n"))
-	if err != nil {
+	if err := trailers.Validate(); err != nil {
 		return err
 	}
+	for _, f := range trailers {
+		if forbiddenTrailer(f.Name) {
+			return fmt.Errorf("error: %q cannot be sent as a trailer", f.Name)
+		}
+		if !w.isAnnounced(f.Name) {
+			return fmt.Errorf("error: trailer %q not announced in the Trailer header", f.Name)
+		}
+	}
 
-	return nil
+	if w.state == writingBody {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+	}
+	w.state = responseDone
+	if w.unchunked || w.head {
+		// Trailers only exist in chunked encoding, which a response to HEAD
+		// only announces
+		return nil
+	}
+	return w.writeFields(trailers)
+}
+
+// forbiddenTrailers are fields that frame, route or authenticate the message,
+// or are needed before the body is processed, so they can't come after it
+var forbiddenTrailers = []string{
+	"Authorization", "Cache-Control", "Connection", "Content-Encoding",
+	"Content-Length", "Content-Range", "Content-Type", "Expect", "Host",
+	"Keep-Alive", "Max-Forwards", "Pragma", "Proxy-Authenticate",
+	"Proxy-Authorization", "Proxy-Connection", "Range", "Set-Cookie", "TE",
+	"Trailer", "Transfer-Encoding", "WWW-Authenticate",
+}
+
+func forbiddenTrailer(name string) bool {
+	for _, forbidden := range forbiddenTrailers {
+		if strings.EqualFold(forbidden, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseContentLength parses a Content-Length value, which may only consist of
+// digits. ParseInt alone would also accept a sign.
+func parseContentLength(value string) (int64, error) {
+	if value == "" {
+		return 0, strconv.ErrSyntax
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return 0, strconv.ErrSyntax
+		}
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// bodyless reports whether responses with status never have a body
+func bodyless(status StatusCode) bool {
+	return status < 200 || status == StatusNoContent || status == StatusNotModified
+}
+
+func (w *Writer) isAnnounced(name string) bool {
+	for _, announced := range w.announced {
+		if strings.EqualFold(announced, name) {
+			return true
+		}
+	}
+	return false
 }
 
+// WriteBody writes p to the body as is, or as a chunk if the headers announced
+// chunked encoding. It can be called several times. If p would take the body
+// past the declared Content-Length nothing is written and ErrContentLength is
+// returned.
 func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.state != writingBody {
 		return 0, fmt.Errorf("error: cannot write body before writing headers")
 	}
-	defer func() {
-		w.state = writingTrailers
-	}()
-
-	return w.writer.Write(p)
+	if w.chunked {
+		// Raw bytes would be read as a chunk size
+		return w.writeBody(p)
+	}
+	if bodyless(w.status) && len(p) > 0 {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.head {
+		return len(p), nil
+	}
+	if w.contentLength >= 0 && w.written+int64(len(p)) > w.contentLength {
+		return 0, ErrContentLength
+	}
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	return n, err
 }
 
+// WriteChunkedBody writes p as a chunk and flushes it, along with anything
+// buffered before it, so streamed bodies reach the client as they are written
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.state != writingBody {
 		return 0, fmt.Errorf("error: cannot write chunked body before writing headers")
 	}
-	hex := fmt.Sprintf("%x", len(p))
-	str := hex + "\r\n" + string(p) + "\r\n"
-	n, err := w.writer.Write([]byte(str))
-
-	if f, ok := w.writer.(http.Flusher); ok {
-		f.Flush()
+	if !w.chunked {
+		return 0, fmt.Errorf("error: cannot write chunked body without chunked encoding")
 	}
-
-	return n, err
+	if w.head {
+		return len(p), nil
+	}
+	if w.unchunked {
+		n, err := w.writer.Write(p)
+		if err != nil {
+			return n, err
+		}
+		return n, w.writer.Flush()
+	}
+	w.writer.WriteString(strconv.FormatInt(int64(len(p)), 16))
+	w.writer.WriteString("\r\n")
+	w.writer.Write(p)
+	if _, err := w.writer.WriteString("\r\n"); err != nil {
+		return 0, err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
+// WriteChunkedBodyDone writes the last chunk. The message is only complete
+// once WriteTrailers is called, which the server does when the handler
+// returns if the handler doesn't.
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.state == writingHeaders {
+		// The whole body is still buffered by Write
+		if err := w.writeBuffered(false); err != nil {
+			return 0, err
+		}
+	}
+	if w.state != writingBody {
+		return 0, fmt.Errorf("error: cannot end chunked body before writing headers")
+	}
+	if !w.chunked {
+		return 0, fmt.Errorf("error: cannot end chunked body without chunked encoding")
+	}
 	defer func() {
 		w.state = writingTrailers
 	}()
+	if w.unchunked || w.head {
+		return 0, nil
+	}
 
-	n, err := w.writer.Write([]byte("0\r\n"))
+	// The trailers follow right away, so the last chunk isn't flushed
+	return w.writer.WriteString("0\r\n")
+}
 
-	if f, ok := w.writer.(http.Flusher); ok {
-		f.Flush()
+// Flush writes everything buffered so far to the connection. If Write has
+// buffered part of the body before the headers were written, the headers are
+// written first with chunked encoding, as the length of the body isn't known
+// yet.
+func (w *Writer) Flush() error {
+	if w.state == writingHeaders && len(w.buf) > 0 {
+		if err := w.writeBuffered(false); err != nil {
+			return err
+		}
 	}
+	return w.writer.Flush()
+}
 
-	return n, err
+// Release returns the Writer's buffer to a pool to be reused by later
+// responses. Anything not flushed is discarded and the Writer must not be
+// used afterwards.
+func (w *Writer) Release() {
+	if w.writer == nil {
+		return
+	}
+	w.writer.Reset(nil)
+	bufferPool.Put(w.writer)
+	w.writer = nil
 }
\ No newline at end of file
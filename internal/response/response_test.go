@@ -0,0 +1,638 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/isotronic/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStatusLine(t *testing.T) {
+	// Test: Registered status code
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusTooManyRequests))
+	require.NoError(t, w.WriteHeaders(nil))
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 429 Too Many Requests\r\n"))
+	assert.Equal(t, StatusTooManyRequests, w.Status())
+
+	// Test: Unregistered status code keeps the space before the empty reason
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(599))
+	require.NoError(t, w.WriteHeaders(nil))
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 599 \r\n"))
+
+	// Test: Custom reason phrase
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLineWithReason(StatusOK, "Totally Fine"))
+	require.NoError(t, w.WriteHeaders(nil))
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 Totally Fine\r\n"))
+
+	// Test: Status line can only be written once
+	require.Error(t, w.WriteStatusLine(StatusOK))
+
+	// Test: Invalid status codes are rejected without writing anything
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.Error(t, w.WriteStatusLine(42))
+	require.Error(t, w.WriteStatusLine(1000))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "", buf.String())
+	assert.Equal(t, StatusCode(0), w.Status())
+
+	// Test: Reason phrase can't inject header lines
+	require.Error(t, w.WriteStatusLineWithReason(StatusOK, "OK\r\nSet-Cookie: x=y"))
+	assert.Equal(t, "", buf.String())
+}
+
+func TestHTTP10(t *testing.T) {
+	chunked := func() headers.Headers {
+		h := headers.NewHeaders()
+		h.Add("Transfer-Encoding", "chunked")
+		h.Add("Trailer", "X-Checksum")
+		return h
+	}
+
+	// Test: Chunked body is written raw and the connection closed
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRequestVersion(1, 0)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked()))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Add("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello world", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Persistent HTTP/1.0 connection is announced
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestVersion(1, 0)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Add("Content-Length", "0")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: HTTP/1.1 clients still get chunks
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestVersion(1, 1)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked()))
+	_, err = w.WriteChunkedBody([]byte("hi"))
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.Contains(t, buf.String(), "\r\n\r\n2\r\nhi\r\n")
+}
+
+func TestWriteHeaders(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetKeepAlive(true)
+	w.Header().Set("X-Request-Id", "abc")
+	w.Header().Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+
+	h := headers.NewHeaders()
+	h.Add("Content-Length", "0")
+	h.Add("Set-Cookie", "a=1")
+	h.Add("Content-Type", "text/html")
+	h.Add("Set-Cookie", "b=2")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+
+	// Test: Handler headers keep their order, casing and duplicates, and win
+	// over the ones set through Header()
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Length: 0\r\n"+
+		"Set-Cookie: a=1\r\n"+
+		"Content-Type: text/html\r\n"+
+		"Set-Cookie: b=2\r\n"+
+		"X-Request-Id: abc\r\n"+
+		"\r\n", buf.String())
+}
+
+func TestHeaderInjection(t *testing.T) {
+	// Test: Invalid header value is rejected without writing anything
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := GetDefaultHeaders(0)
+	h.Add("Location", "/x\r\nSet-Cookie: admin=1")
+	assert.ErrorIs(t, w.WriteHeaders(h), headers.ErrInvalidFieldValue)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "", buf.String())
+	assert.False(t, w.KeepAlive())
+	_, err := w.WriteBody([]byte("x"))
+	assert.Error(t, err)
+
+	// Test: Values set through Header() are checked too
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Header().Set("X-Request-Id", "a\nb")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	assert.ErrorIs(t, w.WriteHeaders(GetDefaultHeaders(0)), headers.ErrInvalidFieldValue)
+
+	// Test: Reset discards the held status line so a different response can
+	// be written
+	assert.False(t, w.HeadersWritten())
+	require.NoError(t, w.Reset())
+	assert.Equal(t, StatusCode(0), w.Status())
+	w.Header().Del("X-Request-Id")
+	require.NoError(t, w.WriteStatusLine(StatusInternalServerError))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 0\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n", buf.String())
+	assert.True(t, w.HeadersWritten())
+	assert.Error(t, w.Reset())
+
+	// Test: Invalid trailer is rejected
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Add("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	buf.Reset()
+	trailers := headers.NewHeaders()
+	trailers.Add("X-Checksum", "abc\r\n\r\ninjected")
+	assert.ErrorIs(t, w.WriteTrailers(trailers), headers.ErrInvalidFieldValue)
+	assert.Equal(t, "", buf.String())
+}
+
+func TestWriteInterim(t *testing.T) {
+	// Test: Interim responses come before the final one
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	h := headers.NewHeaders()
+	h.Add("Link", "</style.css>; rel=preload; as=style")
+	require.NoError(t, w.WriteInterim(StatusEarlyHints, h))
+	require.NoError(t, w.WriteInterim(StatusContinue, nil))
+	assert.Equal(t, StatusCode(0), w.Status())
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(nil))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\n"+
+		"Link: </style.css>; rel=preload; as=style\r\n"+
+		"\r\n"+
+		"HTTP/1.1 100 Continue\r\n"+
+		"\r\n"+
+		"HTTP/1.1 200 OK\r\n"+
+		"Connection: close\r\n"+
+		"\r\n", buf.String())
+
+	// Test: Not allowed after the status line
+	assert.Error(t, w.WriteInterim(StatusContinue, nil))
+
+	// Test: Only 1xx codes other than 101
+	buf.Reset()
+	w = NewWriter(&buf)
+	assert.Error(t, w.WriteInterim(StatusOK, nil))
+	assert.Error(t, w.WriteInterim(StatusSwitchingProtocols, nil))
+	assert.Equal(t, "", buf.String())
+
+	// Test: HTTP/1.0 clients get nothing
+	w.SetRequestVersion(1, 0)
+	require.NoError(t, w.WriteInterim(StatusContinue, nil))
+	assert.Equal(t, "", buf.String())
+}
+
+func TestHeadResponse(t *testing.T) {
+	// Test: Body is dropped but the headers are kept
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Chunked response keeps its headers and the connection
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Add("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: No framing headers doesn't close the connection
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWrite(t *testing.T) {
+	// Test: Small body gets a Content-Length
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetKeepAlive(true)
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := w.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, w.Status())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\nhello world", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Large body switches to chunked encoding
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusCreated))
+	big := bytes.Repeat([]byte("a"), bufferThreshold)
+	_, err = w.Write(big)
+	require.NoError(t, err)
+	assert.Equal(t, "", buf.String())
+	_, err = w.Write([]byte("b"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("c"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"1001\r\n"+string(big)+"b\r\n"+
+		"1\r\nc\r\n"+
+		"0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Writes after explicit headers follow their framing
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(4)))
+	_, err = w.Write([]byte("ab"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("cd"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nabcd", buf.String())
+
+	// Test: Nothing written becomes an empty 200
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", buf.String())
+
+	// Test: Chunked end flushes the buffered body first
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Header().Set("Transfer-Encoding", "chunked")
+	_, err = w.Write([]byte("hi"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(nil))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n2\r\nhi\r\n0\r\n\r\n", buf.String())
+
+	// Test: Nothing can be written once the response is done
+	_, err = w.Write([]byte("x"))
+	assert.Error(t, err)
+}
+
+func TestBodylessStatus(t *testing.T) {
+	// Test: Empty 204 gets no framing headers and keeps the connection
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Content-Length passed for a 204 is dropped
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+
+	// Test: 304 keeps the connection and its Content-Length
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	h := headers.NewHeaders()
+	h.Add("Content-Length", "42")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nContent-Length: 42\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Body is rejected
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	_, err := w.Write([]byte("x"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.WriteHeaders(nil))
+	_, err = w.WriteBody([]byte("x"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+}
+
+func TestContentLength(t *testing.T) {
+	// Test: Writing past the declared length fails without writing
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	require.NoError(t, w.Flush())
+	buf.Reset()
+	_, err := w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	n, err := w.WriteBody([]byte("def"))
+	assert.ErrorIs(t, err, ErrContentLength)
+	assert.Equal(t, 0, n)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "abc", buf.String())
+
+	// Test: Short body is reported and the connection can't be reused
+	assert.ErrorIs(t, w.Finish(), ErrShortBody)
+	assert.False(t, w.KeepAlive())
+
+	// Test: Exact length is fine
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetKeepAlive(true)
+	w.Header().Set("Content-Length", "6")
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("def"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Declared length is checked before buffering
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Header().Set("Content-Length", "3")
+	n, err = w.Write([]byte("hello"))
+	assert.ErrorIs(t, err, ErrContentLength)
+	assert.Equal(t, 0, n)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "Content-Length: 3\r\nConnection: close\r\n\r\nabc"))
+
+	// Test: Content-Length is dropped from a chunked response
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Add("Content-Length", "3")
+	h.Add("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n3\r\nabc\r\n0\r\n\r\n", buf.String())
+
+	// Test: Invalid Content-Length is rejected
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Add("Content-Length", "-1")
+	assert.Error(t, w.WriteHeaders(h))
+	h.Set("Content-Length", "+3")
+	assert.Error(t, w.WriteHeaders(h))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "", buf.String())
+
+	// Test: HEAD responses aren't checked
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(100)))
+	require.NoError(t, w.Finish())
+}
+
+func TestTrailers(t *testing.T) {
+	chunked := func(trailer string) headers.Headers {
+		h := headers.NewHeaders()
+		h.Add("Transfer-Encoding", "chunked")
+		if trailer != "" {
+			h.Add("Trailer", trailer)
+		}
+		return h
+	}
+
+	// Test: Chunked body is terminated even without trailers
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked("")))
+	_, err := w.WriteChunkedBody([]byte("hi"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n2\r\nhi\r\n0\r\n\r\n"))
+
+	// Test: Trailers computed while streaming are written on Finish
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked("X-Checksum, X-Length")))
+	_, err = w.Write([]byte("hi"))
+	require.NoError(t, err)
+	w.Trailer().Set("X-Checksum", "abc")
+	w.Trailer().Set("x-length", "2")
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n2\r\nhi\r\n0\r\nX-Checksum: abc\r\nx-length: 2\r\n\r\n"))
+
+	// Test: WriteTrailers ends the body itself
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked("X-Checksum")))
+	trailers := headers.NewHeaders()
+	trailers.Add("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n0\r\nX-Checksum: abc\r\n\r\n"))
+	require.NoError(t, w.Finish())
+
+	// Test: Unannounced trailer is rejected
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked("X-Checksum")))
+	trailers = headers.NewHeaders()
+	trailers.Add("X-Other", "abc")
+	require.NoError(t, w.Flush())
+	buf.Reset()
+	assert.Error(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "", buf.String())
+
+	// Test: Framing fields can't be announced or sent as trailers
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	assert.Error(t, w.WriteHeaders(chunked("X-Checksum, Content-Length")))
+	require.NoError(t, w.Reset())
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked("X-Checksum")))
+	trailers = headers.NewHeaders()
+	trailers.Add("Content-Length", "99")
+	assert.Error(t, w.WriteTrailers(trailers))
+	trailers = headers.NewHeaders()
+	trailers.Add("host", "example.com")
+	assert.Error(t, w.WriteTrailers(trailers))
+
+	// Test: WriteBody frames the body as chunks when chunked
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked("")))
+	n, err := w.WriteBody([]byte("raw"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n3\r\nraw\r\n0\r\n\r\n"))
+
+	// Test: Trailers and chunks are rejected without chunked encoding
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err = w.WriteChunkedBody([]byte("hi"))
+	assert.Error(t, err)
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	assert.Error(t, err)
+	assert.Error(t, w.WriteTrailers(nil))
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhi"))
+
+	// Test: Announced trailers make a small implicit response chunked
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Header().Set("Trailer", "X-Checksum")
+	_, err = w.Write([]byte("hi"))
+	require.NoError(t, err)
+	w.Trailer().Set("X-Checksum", "abc")
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n2\r\nhi\r\n0\r\nX-Checksum: abc\r\n\r\n"))
+}
+
+// countingWriter records how many writes reach it
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestFlush(t *testing.T) {
+	// Test: Small response goes out in a single write
+	var conn countingWriter
+	w := NewWriter(&conn)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, conn.writes)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, conn.writes)
+	assert.True(t, strings.HasSuffix(conn.String(), "\r\n\r\nhello"))
+	w.Release()
+
+	// Test: Interim response is sent right away
+	conn = countingWriter{}
+	w = NewWriter(&conn)
+	require.NoError(t, w.WriteInterim(StatusContinue, nil))
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", conn.String())
+
+	// Test: Each chunk is flushed, the first one with the headers
+	conn = countingWriter{}
+	w = NewWriter(&conn)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Add("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hi"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, conn.writes)
+	assert.True(t, strings.HasSuffix(conn.String(), "\r\n\r\n2\r\nhi\r\n"))
+	_, err = w.WriteChunkedBody([]byte("there"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, conn.writes)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 3, conn.writes)
+	assert.True(t, strings.HasSuffix(conn.String(), "5\r\nthere\r\n0\r\n\r\n"))
+
+	// Test: Flush sends a body buffered by Write with chunked encoding
+	conn = countingWriter{}
+	w = NewWriter(&conn)
+	_, err = w.Write([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Contains(t, conn.String(), "Transfer-Encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(conn.String(), "\r\n\r\n2\r\nhi\r\n"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(conn.String(), "2\r\nhi\r\n0\r\n\r\n"))
+
+	// Test: Flush doesn't write headers the handler hasn't written yet, and
+	// the status line waits for them
+	conn = countingWriter{}
+	w = NewWriter(&conn)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "", conn.String())
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+}
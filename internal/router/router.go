@@ -0,0 +1,212 @@
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/isotronic/httpfromtcp/internal/request"
+	"github.com/isotronic/httpfromtcp/internal/response"
+	"github.com/isotronic/httpfromtcp/internal/server"
+)
+
+// Router dispatches requests to handlers registered by method and path
+// pattern. Its Dispatch method can be passed to server.Serve as the Handler.
+type Router struct {
+	routes []route
+}
+
+type route struct {
+	method   string
+	segments []segment
+	handler  server.Handler
+}
+
+type segmentKind int
+
+const (
+	literal segmentKind = iota
+	param
+	wildcard
+)
+
+// segment is one "/"-separated part of a pattern
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+// New creates an empty Router
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for pattern, which is an optional method followed
+// by a path, e.g. "GET /users/{id}" or "/static/*". A "{name}" segment matches
+// any single path segment and a trailing "*" matches the rest of the path.
+// Matched values are available through req.PathValue. Without a method the
+// route matches every method. Handle panics on a malformed pattern.
+func (rt *Router) Handle(pattern string, handler server.Handler) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		method, path = "", pattern
+	}
+	if !strings.HasPrefix(path, "/") {
+		panic(fmt.Sprintf("router: pattern %q must start with /", pattern))
+	}
+
+	parts := strings.Split(path[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	for i, part := range parts {
+		switch {
+		case part == "*":
+			if i != len(parts)-1 {
+				panic(fmt.Sprintf("router: wildcard in pattern %q must be the last segment", pattern))
+			}
+			segments = append(segments, segment{kind: wildcard, value: "*"})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" {
+				panic(fmt.Sprintf("router: empty parameter name in pattern %q", pattern))
+			}
+			segments = append(segments, segment{kind: param, value: name})
+		default:
+			segments = append(segments, segment{kind: literal, value: part})
+		}
+	}
+
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		segments: segments,
+		handler:  handler,
+	})
+}
+
+// Dispatch runs the handler of the best matching route. The most specific
+// route wins: literal segments beat parameters, which beat wildcards. HEAD
+// requests are served by GET routes unless there is a HEAD route. If the
+// path matches but the method does not, it returns a 405 error and sets an
+// Allow header listing the registered methods, otherwise a 404 error.
+func (rt *Router) Dispatch(w *response.Writer, req *request.Request) error {
+	// The path is split before decoding, so an encoded "/" stays part of
+	// its segment
+	path := req.RawPath
+
+	var best *route
+	var bestParams map[string]string
+	allowed := map[string]bool{}
+	for i := range rt.routes {
+		r := &rt.routes[i]
+		params, ok := r.match(path)
+		if !ok {
+			continue
+		}
+		if !r.allows(req.RequestLine.Method) {
+			allowed[r.method] = true
+			if r.method == "GET" {
+				allowed["HEAD"] = true
+			}
+			continue
+		}
+		if best == nil || r.moreSpecific(best, req.RequestLine.Method) {
+			best, bestParams = r, params
+		}
+	}
+
+	if best == nil {
+		if len(allowed) > 0 {
+			return methodNotAllowed(w, allowed)
+		}
+		return &server.HandlerError{StatusCode: response.StatusNotFound, Message: "Not Found"}
+	}
+
+	req.PathParams = bestParams
+	return best.handler(w, req)
+}
+
+// match reports whether the escaped path matches the route and returns the
+// decoded values of its parameters
+func (r *route) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	parts := strings.Split(path[1:], "/")
+	params := map[string]string{}
+	for i, seg := range r.segments {
+		if seg.kind == wildcard {
+			value, err := url.PathUnescape(strings.Join(parts[i:], "/"))
+			if err != nil {
+				return nil, false
+			}
+			params["*"] = value
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		part, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, false
+		}
+		switch seg.kind {
+		case literal:
+			if part != seg.value {
+				return nil, false
+			}
+		case param:
+			if part == "" {
+				return nil, false
+			}
+			params[seg.value] = part
+		}
+	}
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// allows reports whether the route handles method. GET routes also handle
+// HEAD, the writer drops the body of the response.
+func (r *route) allows(method string) bool {
+	return r.method == "" || r.method == method || (r.method == "GET" && method == "HEAD")
+}
+
+// moreSpecific reports whether r should be preferred over other when both
+// match the same request for method
+func (r *route) moreSpecific(other *route, method string) bool {
+	for i := 0; i < len(r.segments) && i < len(other.segments); i++ {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(r.segments) != len(other.segments) {
+		return len(r.segments) > len(other.segments)
+	}
+	// A route for the exact method beats a GET route serving HEAD, which
+	// beats one for any method
+	return methodRank(r.method, method) > methodRank(other.method, method)
+}
+
+func methodRank(routeMethod, method string) int {
+	switch routeMethod {
+	case method:
+		return 2
+	case "":
+		return 0
+	default:
+		return 1
+	}
+}
+
+func methodNotAllowed(w *response.Writer, allowed map[string]bool) error {
+	methods := make([]string, 0, len(allowed))
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	return &server.HandlerError{StatusCode: response.StatusMethodNotAllowed, Message: "Method Not Allowed"}
+}
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/isotronic/httpfromtcp/internal/request"
+	"github.com/isotronic/httpfromtcp/internal/response"
+	"github.com/isotronic/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// named returns a handler that writes name as the body
+func named(name string) server.Handler {
+	return func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(name)))
+		_, err := w.WriteBody([]byte(name))
+		return err
+	}
+}
+
+// dispatch runs a request for method and target through rt and returns the
+// raw response, the request as seen by the handler and the error returned
+// by Dispatch
+func dispatch(t *testing.T, rt *Router, method, target string) (string, *request.Request, error) {
+	t.Helper()
+	req, err := request.RequestFromReader(bytes.NewReader([]byte(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n")))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	w.SetRequestMethod(method)
+	err = rt.Dispatch(w, req)
+	if err != nil {
+		// Render the error the way the server would
+		w.WriteStatusLine(server.ErrorStatus(err))
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}
+	require.NoError(t, w.Flush())
+	return buf.String(), req, err
+}
+
+func TestDispatch(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /", named("root"))
+	rt.Handle("GET /users/{id}", named("user"))
+	rt.Handle("DELETE /users/{id}", named("delete"))
+	rt.Handle("GET /users/me", named("me"))
+	rt.Handle("/static/*", named("static"))
+	rt.Handle("GET /static/favicon.ico", named("favicon"))
+
+	// Test: Exact match
+	res, _, _ := dispatch(t, rt, "GET", "/")
+	assert.Contains(t, res, "HTTP/1.1 200 OK")
+	assert.Contains(t, res, "root")
+
+	// Test: Path parameter
+	res, req, _ := dispatch(t, rt, "GET", "/users/42?verbose=1")
+	assert.Contains(t, res, "user")
+	assert.Equal(t, "42", req.PathValue("id"))
+
+	// Test: Method selects the route
+	res, req, _ = dispatch(t, rt, "DELETE", "/users/42")
+	assert.Contains(t, res, "delete")
+	assert.Equal(t, "42", req.PathValue("id"))
+
+	// Test: Path is matched after percent-decoding
+	res, req, _ = dispatch(t, rt, "GET", "/users/j%C3%BCrgen")
+	assert.Contains(t, res, "user")
+	assert.Equal(t, "jürgen", req.PathValue("id"))
+
+	// Test: Encoded slash stays inside the parameter
+	res, req, _ = dispatch(t, rt, "GET", "/users/a%2Fb")
+	assert.Contains(t, res, "user")
+	assert.Equal(t, "a/b", req.PathValue("id"))
+
+	// Test: Literal beats parameter
+	res, _, _ = dispatch(t, rt, "GET", "/users/me")
+	assert.Contains(t, res, "me")
+
+	// Test: Wildcard matches the rest of the path for any method
+	res, req, _ = dispatch(t, rt, "POST", "/static/css/site.css")
+	assert.Contains(t, res, "static")
+	assert.Equal(t, "css/site.css", req.PathValue("*"))
+
+	// Test: Literal beats wildcard
+	res, _, _ = dispatch(t, rt, "GET", "/static/favicon.ico")
+	assert.Contains(t, res, "favicon")
+
+	// Test: HEAD is served by the GET route without a body
+	res, req, _ = dispatch(t, rt, "HEAD", "/users/42")
+	assert.Contains(t, res, "HTTP/1.1 200 OK")
+	assert.Contains(t, res, "Content-Length: 4\r\n")
+	assert.NotContains(t, res, "user")
+	assert.Equal(t, "42", req.PathValue("id"))
+
+	// Test: HEAD route beats the GET route
+	rt.Handle("HEAD /users/{id}", named("head route"))
+	res, _, _ = dispatch(t, rt, "HEAD", "/users/42")
+	assert.Contains(t, res, "Content-Length: 10\r\n")
+	res, _, _ = dispatch(t, rt, "GET", "/users/42")
+	assert.Contains(t, res, "user")
+
+	// Test: Unknown path
+	res, _, err := dispatch(t, rt, "GET", "/nope")
+	assert.Equal(t, response.StatusNotFound, server.ErrorStatus(err))
+	assert.Contains(t, res, "HTTP/1.1 404 Not Found")
+
+	// Test: Parameter doesn't match an extra segment
+	res, _, err = dispatch(t, rt, "GET", "/users/42/posts")
+	assert.Equal(t, response.StatusNotFound, server.ErrorStatus(err))
+	assert.Contains(t, res, "HTTP/1.1 404 Not Found")
+
+	// Test: Known path with the wrong method
+	res, _, err = dispatch(t, rt, "PUT", "/users/42")
+	assert.Equal(t, response.StatusMethodNotAllowed, server.ErrorStatus(err))
+	assert.Contains(t, res, "HTTP/1.1 405 Method Not Allowed")
+	assert.Contains(t, res, "Allow: DELETE, GET, HEAD\r\n")
+}
+
+func TestHandleInvalidPattern(t *testing.T) {
+	rt := New()
+	assert.Panics(t, func() { rt.Handle("GET users", named("x")) })
+	assert.Panics(t, func() { rt.Handle("/static/*/x", named("x")) })
+	assert.Panics(t, func() { rt.Handle("/users/{}", named("x")) })
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// dateCache holds the value of the Date header, formatted at most once per
+// second however many responses are written
+type dateCache struct {
+	current atomic.Pointer[formattedDate]
+}
+
+type formattedDate struct {
+	second int64
+	value  string
+}
+
+// get returns now as an IMF-fixdate, e.g. "Sun, 06 Nov 1994 08:49:37 GMT"
+func (c *dateCache) get(now time.Time) string {
+	second := now.Unix()
+	if d := c.current.Load(); d != nil && d.second == second {
+		return d.value
+	}
+	d := &formattedDate{second: second, value: now.UTC().Format(http.TimeFormat)}
+	c.current.Store(d)
+	return d.value
+}
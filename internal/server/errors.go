@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/isotronic/httpfromtcp/internal/headers"
+	"github.com/isotronic/httpfromtcp/internal/request"
+	"github.com/isotronic/httpfromtcp/internal/response"
+)
+
+// HandlerError is an error a Handler can return to have the server respond
+// with StatusCode and Message as a plain text body
+type HandlerError struct {
+	StatusCode response.StatusCode
+	Message    string
+}
+
+func (e *HandlerError) Error() string {
+	return e.Message
+}
+
+// Status returns the status code to respond with
+func (e *HandlerError) Status() response.StatusCode {
+	return e.StatusCode
+}
+
+// StatusError is implemented by errors that know which status code the
+// server should respond with, such as *HandlerError
+type StatusError interface {
+	error
+	Status() response.StatusCode
+}
+
+// ErrorStatus returns the status code the server responds with when a
+// handler returns err: the error's own status if it implements StatusError,
+// 413 Content Too Large if reading the body hit the size limit, 408 Request
+// Timeout if reading the body timed out, otherwise 500 Internal Server Error
+func ErrorStatus(err error) response.StatusCode {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status()
+	}
+	if errors.Is(err, request.ErrBodyTooLarge) {
+		return response.StatusContentTooLarge
+	}
+	if isTimeout(err) {
+		return response.StatusRequestTimeout
+	}
+	return response.StatusInternalServerError
+}
+
+// isTimeout reports whether err is a connection deadline expiring
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// requestErrorStatus returns the status code to respond with when a request
+// could not be read
+func requestErrorStatus(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return response.StatusURITooLong
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		return response.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.StatusContentTooLarge
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.StatusHTTPVersionNotSupported
+	case errors.Is(err, request.ErrUnsupportedEncoding):
+		return response.StatusNotImplemented
+	default:
+		return response.StatusBadRequest
+	}
+}
+
+// writeError responds to a failed request. Errors with a status have their
+// message sent to the client, other errors are not exposed and just get the
+// reason phrase of the status. If a header the handler set through
+// w.Header() is invalid, a bare 500 Internal Server Error is sent instead and
+// the header error is returned.
+func writeError(w *response.Writer, err error) error {
+	status := ErrorStatus(err)
+	message := response.StatusText(status)
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		message = statusErr.Error()
+	}
+
+	// The error replaces whatever body the handler meant to send, so the
+	// framing it set up doesn't apply
+	w.Header().Del("Content-Length")
+	w.Header().Del("Transfer-Encoding")
+	w.Header().Del("Trailer")
+
+	body := message + "\n"
+	w.WriteStatusLine(status)
+	headerErr := w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	if headerErr != nil {
+		// Drop the fields the handler got wrong and send a bare 500
+		w.Reset()
+		var valid headers.Headers
+		for _, f := range *w.Header() {
+			if headers.ValidFieldName(f.Name) && headers.ValidFieldValue(f.Value) {
+				valid = append(valid, f)
+			}
+		}
+		*w.Header() = valid
+		body = response.StatusText(response.StatusInternalServerError) + "\n"
+		w.WriteStatusLine(response.StatusInternalServerError)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	}
+	w.WriteBody([]byte(body))
+	return headerErr
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/isotronic/httpfromtcp/internal/request"
+	"github.com/isotronic/httpfromtcp/internal/response"
+)
+
+// Middleware wraps a Handler to add behaviour before or after it runs
+type Middleware func(Handler) Handler
+
+// Chain wraps handler with the given middleware. The first middleware is the
+// outermost one, so it runs first and sees the request before the others.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Logging logs the method, target, status and duration of every request to l,
+// or to the standard logger if l is nil
+func Logging(l *log.Logger) Middleware {
+	if l == nil {
+		l = log.Default()
+	}
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) error {
+			start := time.Now()
+			err := next(w, req)
+			status := w.Status()
+			if err != nil && status == 0 {
+				status = ErrorStatus(err)
+			}
+			l.Printf("%s %s %d %v", req.RequestLine.Method, req.RequestLine.RequestTarget, status, time.Since(start))
+			return err
+		}
+	}
+}
+
+// Timing logs requests whose handler takes longer than threshold
+func Timing(threshold time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) error {
+			start := time.Now()
+			err := next(w, req)
+			if elapsed := time.Since(start); elapsed > threshold {
+				log.Printf("Slow request: %s %s took %v", req.RequestLine.Method, req.RequestLine.RequestTarget, elapsed)
+			}
+			return err
+		}
+	}
+}
+
+// Recover turns a panic in the handler into a logged error and a 500
+// response. If the response was already started the connection is closed
+// instead.
+func Recover(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, r, debug.Stack())
+				err = &HandlerError{StatusCode: response.StatusInternalServerError, Message: "Internal Server Error"}
+			}
+		}()
+		return next(w, req)
+	}
+}
+
+// RequestID makes sure every request has an X-Request-Id header, generating
+// one if the client didn't send it, and echoes it on the response
+func RequestID(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) error {
+		id := req.Headers.Get("X-Request-Id")
+		if id == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+			req.Headers.Set("X-Request-Id", id)
+		}
+		w.Header().Set("X-Request-Id", id)
+		return next(w, req)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/isotronic/httpfromtcp/internal/request"
+	"github.com/isotronic/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRequest parses a GET request for target with the given extra header lines
+func newRequest(t *testing.T, target string, headerLines ...string) *request.Request {
+	t.Helper()
+	raw := "GET " + target + " HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(headerLines, "") + "\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) error {
+				calls = append(calls, name)
+				return next(w, req)
+			}
+		}
+	}
+	h := Chain(func(w *response.Writer, req *request.Request) error {
+		calls = append(calls, "handler")
+		return nil
+	}, trace("outer"), trace("inner"))
+
+	h(response.NewWriter(&bytes.Buffer{}), newRequest(t, "/"))
+	assert.Equal(t, []string{"outer", "inner", "handler"}, calls)
+}
+
+func TestRecover(t *testing.T) {
+	h := Recover(func(w *response.Writer, req *request.Request) error {
+		panic("boom")
+	})
+	err := h(response.NewWriter(&bytes.Buffer{}), newRequest(t, "/"))
+	assert.Equal(t, response.StatusInternalServerError, ErrorStatus(err))
+}
+
+func TestRequestID(t *testing.T) {
+	// Test: ID is generated when missing
+	var buf bytes.Buffer
+	req := newRequest(t, "/")
+	w := response.NewWriter(&buf)
+	RequestID(okHandler)(w, req)
+	require.NoError(t, w.Flush())
+	id := req.Headers.Get("x-request-id")
+	assert.Len(t, id, 32)
+	assert.Contains(t, buf.String(), "X-Request-Id: "+id+"\r\n")
+
+	// Test: Client ID is kept
+	buf.Reset()
+	req = newRequest(t, "/", "X-Request-Id: abc123\r\n")
+	w = response.NewWriter(&buf)
+	RequestID(okHandler)(w, req)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "abc123", req.Headers.Get("x-request-id"))
+	assert.Contains(t, buf.String(), "X-Request-Id: abc123\r\n")
+}
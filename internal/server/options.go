@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+)
+
+// Option configures optional Server behaviour
+type Option func(*Server)
+
+// WithNetwork sets the network Serve listens on: "tcp" (the default), "tcp4",
+// "tcp6" or "unix"
+func WithNetwork(network string) Option {
+	return func(s *Server) {
+		s.network = network
+	}
+}
+
+// WithAddr sets the address Serve listens on, replacing the port argument.
+// It is a host:port pair for TCP networks (e.g. "127.0.0.1:8080") and a socket
+// path for "unix".
+func WithAddr(addr string) Option {
+	return func(s *Server) {
+		s.addr = addr
+	}
+}
+
+// WithTLSConfig serves HTTPS by wrapping the listener with TLS. The config
+// must contain at least one certificate or set GetCertificate.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithErrorLog sets the logger used for connection and handler errors.
+// Errors go to the standard logger by default.
+func WithErrorLog(l *log.Logger) Option {
+	return func(s *Server) {
+		s.errorLog = l
+	}
+}
+
+// WithConnState sets a hook that is called whenever a connection changes
+// state, e.g. to count open connections
+func WithConnState(hook func(net.Conn, ConnState)) Option {
+	return func(s *Server) {
+		s.connStateHook = hook
+	}
+}
+
+// WithReadHeaderTimeout sets how long a client may take to send the request
+// line and headers once it has started a request. Zero disables the timeout.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readHeaderTimeout = d
+	}
+}
+
+// WithReadTimeout sets how long a client may take to send an entire request,
+// including the body. Zero disables the timeout.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout = d
+	}
+}
+
+// WithWriteTimeout sets how long a handler may take to write its response,
+// counted from when the request has been read. Zero disables the timeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithIdleTimeout sets how long a persistent connection may wait for the next
+// request before it is closed. Zero disables the timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithMaxRequestsPerConn sets how many requests are served on a single
+// connection before it is closed. Zero means no limit.
+func WithMaxRequestsPerConn(n int) Option {
+	return func(s *Server) {
+		s.maxRequestsPerConn = n
+	}
+}
+
+// WithMaxRequestLineBytes limits the length of the request line. Longer ones
+// are answered with 414 URI Too Long. Zero means no limit.
+func WithMaxRequestLineBytes(n int) Option {
+	return func(s *Server) {
+		s.limits.MaxRequestLineBytes = n
+	}
+}
+
+// WithMaxHeaderBytes limits the total size of the header fields. Larger ones
+// are answered with 431 Request Header Fields Too Large. Zero means no limit.
+func WithMaxHeaderBytes(n int) Option {
+	return func(s *Server) {
+		s.limits.MaxHeaderBytes = n
+	}
+}
+
+// WithMaxHeaderCount limits the number of header fields. More are answered
+// with 431 Request Header Fields Too Large. Zero means no limit.
+func WithMaxHeaderCount(n int) Option {
+	return func(s *Server) {
+		s.limits.MaxHeaderCount = n
+	}
+}
+
+// WithMaxBodyBytes limits the size of request bodies. A larger Content-Length
+// is answered with 413 Content Too Large right away; a chunked body fails
+// with request.ErrBodyTooLarge once it reaches the limit. Zero means no limit.
+func WithMaxBodyBytes(n int) Option {
+	return func(s *Server) {
+		s.limits.MaxBodyBytes = n
+	}
+}
+
+// WithLenientHeaders accepts header lines ending in a bare LF and unfolds
+// obsolete line folding instead of answering them with 400 Bad Request. Only
+// use it for old clients that need it.
+func WithLenientHeaders() Option {
+	return func(s *Server) {
+		s.lenientHeaders = true
+	}
+}
+
+// WithServerName sets the Server header sent with every response, which is
+// "httpfromtcp" by default. An empty name leaves the header out.
+func WithServerName(name string) Option {
+	return func(s *Server) {
+		s.serverName = name
+	}
+}
@@ -1,47 +1,153 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"runtime/debug"
 	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/isotronic/httpfromtcp/internal/request"
 	"github.com/isotronic/httpfromtcp/internal/response"
 )
 
+const (
+	defaultReadHeaderTimeout  = 10 * time.Second
+	defaultIdleTimeout        = 2 * time.Minute
+	defaultMaxRequestsPerConn = 100
+	defaultServerName         = "httpfromtcp"
+
+	// errorWriteTimeout bounds how long we try to tell a misbehaving client
+	// why its connection is being closed
+	errorWriteTimeout = time.Second
+
+	// drainTimeout bounds how long we wait for the rest of a body the
+	// handler didn't read when there is no header timeout to go by
+	drainTimeout = 5 * time.Second
+
+	shutdownPollInterval = 10 * time.Millisecond
+)
+
 type Server struct {
 	handler		Handler
 	listener 	net.Listener
 	isClosed 	atomic.Bool
-}
 
-type HandlerError struct {
-	StatusCode response.StatusCode
-	Message    string
+	network       string
+	addr          string
+	tlsConfig     *tls.Config
+	errorLog      *log.Logger
+	connStateHook func(net.Conn, ConnState)
+
+	readHeaderTimeout  time.Duration
+	readTimeout        time.Duration
+	writeTimeout       time.Duration
+	idleTimeout        time.Duration
+	maxRequestsPerConn int
+	limits             request.Limits
+	lenientHeaders     bool
+	serverName         string
+
+	date dateCache
+
+	mu    sync.Mutex
+	conns map[net.Conn]ConnState
 }
 
-type Handler func(w *response.Writer, req *request.Request)
+// ConnState is what a connection is currently doing
+type ConnState int
+
+const (
+	// StateNew connections have just been accepted and are expected to send
+	// a request right away
+	StateNew ConnState = iota
+	// StateActive connections are reading a request or running a handler
+	StateActive
+	// StateIdle connections are waiting for the next request and can be closed
+	// without cutting off a response
+	StateIdle
+	// StateClosed connections have been closed and are no longer tracked
+	StateClosed
+)
+
+// Handler responds to a request. If it returns an error before the headers
+// are written, the server responds according to the error (see HandlerError)
+// in place of any status line the handler set. If the headers were already
+// written, the error is logged and the connection closed.
+type Handler func(w *response.Writer, req *request.Request) error
 
-func Serve(port int, handler Handler) (*Server, error) {
-	p := strconv.Itoa(port)
-	l, err := net.Listen("tcp", ":" + p)
+// Serve listens on the given port on all interfaces and serves requests
+// with handler in the background. Options can change the address, network
+// and other settings.
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	server := newServer(handler, opts)
+	addr := server.addr
+	if addr == "" {
+		addr = ":" + strconv.Itoa(port)
+	}
+	l, err := net.Listen(server.network, addr)
 	if err != nil {
 		return nil, err
 	}
+
+	server.start(l)
+
+	return server, nil
+}
+
+// ServeListener serves requests from an existing listener with handler in the
+// background. The server takes ownership of l and closes it on Close or
+// Shutdown. WithNetwork and WithAddr have no effect.
+func ServeListener(l net.Listener, handler Handler, opts ...Option) *Server {
+	server := newServer(handler, opts)
+	server.start(l)
+	return server
+}
+
+func newServer(handler Handler, opts []Option) *Server {
 	server := Server{
 		handler: handler,
-		listener: l,
+		network: "tcp",
+		readHeaderTimeout: defaultReadHeaderTimeout,
+		idleTimeout: defaultIdleTimeout,
+		maxRequestsPerConn: defaultMaxRequestsPerConn,
+		serverName: defaultServerName,
+		limits: request.DefaultLimits,
+		conns: make(map[net.Conn]ConnState),
+	}
+	for _, opt := range opts {
+		opt(&server)
 	}
+	return &server
+}
+
+func (s *Server) start(l net.Listener) {
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	s.listener = l
 
-	go server.listen()
+	go s.listen()
+}
 
-	return &server, nil
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
+// Close stops accepting connections and closes all open connections
+// immediately, including those with requests in flight. Use Shutdown to let
+// them finish first.
 func (s *Server) Close() error {
 	s.isClosed.Store(true)
 	err := s.listener.Close()
+	s.closeConns(false)
 	if err != nil {
 		return err
 	}
@@ -49,6 +155,85 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Shutdown stops accepting connections, closes idle connections and waits for
+// in-flight requests to finish before closing their connections too. If ctx
+// expires first, the remaining connections are closed forcefully and the
+// context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.isClosed.Store(true)
+	err := s.listener.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeConns(true) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns(false)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeConns closes tracked connections, only those not serving a request if
+// idleOnly is set, and reports whether no connections are left. Closed
+// connections stay tracked as StateClosed until their goroutine untracks them.
+func (s *Server) closeConns(idleOnly bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == StateClosed || (idleOnly && state == StateActive) {
+			continue
+		}
+		conn.Close()
+		s.conns[conn] = StateClosed
+	}
+	return len(s.conns) == 0
+}
+
+// setConnState records what conn is doing. It returns false if the server is
+// shutting down and a connection that is not serving a request should be
+// closed instead of used.
+func (s *Server) setConnState(conn net.Conn, state ConnState) bool {
+	s.mu.Lock()
+	if (state != StateActive && s.isClosed.Load()) || s.conns[conn] == StateClosed {
+		s.mu.Unlock()
+		return false
+	}
+	s.conns[conn] = state
+	s.mu.Unlock()
+
+	if s.connStateHook != nil {
+		s.connStateHook(conn, state)
+	}
+	return true
+}
+
+// untrackConn forgets a closed connection. Shutdown waits for this, so the
+// hook sees StateClosed before Shutdown returns, unless its context expires
+// first.
+func (s *Server) untrackConn(conn net.Conn) {
+	if s.connStateHook != nil {
+		s.connStateHook(conn, StateClosed)
+	}
+
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// logf logs to the configured error log, or the standard logger
+func (s *Server) logf(format string, args ...any) {
+	if s.errorLog != nil {
+		s.errorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
 func (s *Server) listen() {
 	for {
 		if s.isClosed.Load() {
@@ -59,7 +244,7 @@ func (s *Server) listen() {
 			if s.isClosed.Load() {
 				break
 			}
-			log.Println("Error accepting connection:", err)
+			s.logf("Error accepting connection: %v", err)
 			continue
 		}
 
@@ -67,16 +252,218 @@ func (s *Server) listen() {
 	}
 }
 
+// handle serves requests on conn until the client or the handler asks for the
+// connection to be closed, a timeout expires or the request limit for the
+// connection is reached
 func (s *Server) handle(conn net.Conn) {
+	defer s.untrackConn(conn)
 	defer conn.Close()
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		log.Println("Error parsing request:", err)
-		return
+	defer func() {
+		// A panic outside a handler (handlers are covered by serveRequest)
+		// only takes down this connection
+		if r := recover(); r != nil {
+			s.logf("Panic serving connection from %v: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+	reader := request.NewReader(conn)
+	reader.Limits = s.limits
+	reader.Lenient = s.lenientHeaders
+
+	for served := 1; ; served++ {
+		state := StateIdle
+		if served == 1 {
+			state = StateNew
+		}
+		if !s.setConnState(conn, state) {
+			return
+		}
+
+		// Before the first request the client gets as long as it would have
+		// to send the headers, after that it may idle for a while
+		waitTimeout := s.idleTimeout
+		if served == 1 {
+			waitTimeout = s.readHeaderTimeout
+		}
+		conn.SetReadDeadline(deadline(time.Now(), waitTimeout))
+		err := reader.Wait()
+		if err != nil {
+			if !s.isClosed.Load() && !isIdleClose(err) {
+				s.logf("Error reading from connection: %v", err)
+			}
+			return
+		}
+		if !s.setConnState(conn, StateActive) {
+			return
+		}
+
+		start := time.Now()
+		conn.SetReadDeadline(earliest(deadline(start, s.readHeaderTimeout), deadline(start, s.readTimeout)))
+		req, err := reader.ReadRequest()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				s.writeStatus(conn, response.StatusRequestTimeout)
+			} else if !errors.As(err, &netErr) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				// The client is still there but sent something we can't parse
+				// or that is over our limits
+				s.writeStatus(conn, requestErrorStatus(err))
+			}
+			s.logf("Error parsing request: %v", err)
+			return
+		}
+		// The header timeout no longer applies while the handler reads the
+		// body
+		conn.SetReadDeadline(deadline(start, s.readTimeout))
+		conn.SetWriteDeadline(deadline(time.Now(), s.writeTimeout))
+
+		// Create a new response.Writer
+		responseWriter := s.newWriter(conn)
+		responseWriter.SetRequestVersion(req.RequestLine.Major, req.RequestLine.Minor)
+		responseWriter.SetRequestMethod(req.RequestLine.Method)
+		responseWriter.SetKeepAlive(s.keepAlive(req, served))
+
+		// Clients sending "Expect: 100-continue" wait for the go-ahead,
+		// which is only given once the handler reads the body
+		req.SetContinue(func() error {
+			if responseWriter.HeadersWritten() {
+				return nil
+			}
+			return responseWriter.WriteInterim(response.StatusContinue, nil)
+		})
+		// If the handler responds without reading the body, the client may
+		// or may not send it, so the connection can't be reused
+		responseWriter.SetBeforeHeaders(func() {
+			if req.ExpectsContinue() {
+				responseWriter.SetKeepAlive(false)
+			}
+		})
+
+		if req.Headers.Has("Expect") && !req.Headers.HasToken("Expect", "100-continue") {
+			// 100-continue is the only expectation there is
+			err = &HandlerError{StatusCode: response.StatusExpectationFailed, Message: response.StatusText(response.StatusExpectationFailed)}
+		} else {
+			err = s.serveRequest(responseWriter, req)
+		}
+		if err != nil {
+			err = s.handleError(responseWriter, req, err)
+		} else if err = responseWriter.Finish(); err != nil {
+			s.logf("Error finishing response for %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+		}
+		responseWriter.Release()
+
+		if err != nil || !responseWriter.KeepAlive() {
+			return
+		}
+		// Skip whatever the handler left of the body to get to the next
+		// request. A client that stopped sending it gets as long as it
+		// would have to send headers, so it can't hold the connection.
+		drain := s.readHeaderTimeout
+		if drain <= 0 {
+			drain = drainTimeout
+		}
+		conn.SetReadDeadline(earliest(deadline(start, s.readTimeout), deadline(time.Now(), drain)))
+		if err := req.BodyReader.Close(); err != nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// serveRequest runs the handler, turning a panic into an error so it is
+// answered with a 500, or aborts the connection if the headers were written
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("Panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, r, debug.Stack())
+			err = &HandlerError{StatusCode: response.StatusInternalServerError, Message: "Internal Server Error"}
+		}
+	}()
+	return s.handler(w, req)
+}
+
+// handleError responds with the error a handler returned, or aborts the
+// connection if the handler already wrote the headers of its response. It
+// returns an error if the response couldn't be sent.
+func (s *Server) handleError(w *response.Writer, req *request.Request, err error) error {
+	if w.HeadersWritten() {
+		s.logf("Error after response started for %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+		w.SetKeepAlive(false)
+		// What was written goes out as is, so a chunked body stays
+		// unterminated and the client can tell it was cut short
+		return w.Flush()
+	}
+	if ErrorStatus(err) >= response.StatusInternalServerError {
+		s.logf("Error serving %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+	}
+	if isTimeout(err) {
+		// The rest of the request can no longer be read from the connection
+		w.SetKeepAlive(false)
+	}
+	// A status line the handler set is still held back and is replaced
+	w.Reset()
+	if err := writeError(w, err); err != nil {
+		s.logf("Error writing error response for %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+	}
+	return w.Finish()
+}
+
+// writeStatus responds with status when no request could be read, before the
+// connection is closed
+func (s *Server) writeStatus(conn net.Conn, status response.StatusCode) {
+	conn.SetWriteDeadline(time.Now().Add(errorWriteTimeout))
+	w := s.newWriter(conn)
+	defer w.Release()
+	writeError(w, &HandlerError{StatusCode: status, Message: response.StatusText(status)})
+	w.Finish()
+}
+
+// newWriter creates a response.Writer for conn with the Date and Server
+// headers set. Handlers can override them, or suppress them by deleting them
+// from w.Header().
+func (s *Server) newWriter(conn net.Conn) *response.Writer {
+	w := response.NewWriter(conn)
+	w.Header().Set("Date", s.date.get(time.Now()))
+	if s.serverName != "" {
+		w.Header().Set("Server", s.serverName)
 	}
+	return w
+}
 
-	// Create a new response.Writer
-	responseWriter := response.NewWriter(conn)
+// keepAlive decides whether the connection should stay open after responding
+// to req, the served-th request on the connection
+func (s *Server) keepAlive(req *request.Request, served int) bool {
+	if s.isClosed.Load() {
+		return false
+	}
+	if s.maxRequestsPerConn > 0 && served >= s.maxRequestsPerConn {
+		return false
+	}
+	// HTTP/1.0 clients have to ask for a persistent connection
+	if !req.RequestLine.ProtoAtLeast(1, 1) {
+		return req.Headers.HasToken("Connection", "keep-alive")
+	}
+	return !req.Headers.HasToken("Connection", "close")
+}
 
-	s.handler(responseWriter, req)
+// isIdleClose reports whether err just means the client went away or stayed
+// silent between requests, which is not worth logging
+func isIdleClose(err error) bool {
+	return errors.Is(err, io.EOF) || isTimeout(err)
+}
+
+// deadline returns the time d after start, or the zero time (no deadline) if
+// d is zero
+func deadline(start time.Time, d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return start.Add(d)
+}
+
+// earliest returns the earlier of two deadlines, ignoring unset ones
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
 }
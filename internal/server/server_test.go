@@ -0,0 +1,873 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/isotronic/httpfromtcp/internal/request"
+	"github.com/isotronic/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// okHandler responds with a short plain text body
+func okHandler(w *response.Writer, req *request.Request) error {
+	body := "ok"
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, err := w.WriteBody([]byte(body))
+	return err
+}
+
+// startServer serves handler on a random local port until the test ends
+func startServer(t *testing.T, handler Handler, opts ...Option) *Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := ServeListener(l, handler, opts...)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// roundTrip sends a raw request on conn and reads the response, including
+// its body, so the next response can be read from reader
+func roundTrip(t *testing.T, conn net.Conn, reader *bufio.Reader, raw string) *http.Response {
+	t.Helper()
+	_, err := conn.Write([]byte(raw))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := startServer(t, okHandler, WithMaxRequestsPerConn(3))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Connection is reused by default
+	res := roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.False(t, res.Close)
+	res = roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.False(t, res.Close)
+
+	// Test: Request limit closes the connection
+	res = roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, res.Close)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Client asks for the connection to be closed
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader = bufio.NewReader(conn)
+	res = roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, res.Close)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: HTTP/1.0 connections close by default
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader = bufio.NewReader(conn)
+	res = roundTrip(t, conn, reader, "GET / HTTP/1.0\r\n\r\n")
+	assert.True(t, res.Close)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: HTTP/1.0 client asks for a persistent connection
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader = bufio.NewReader(conn)
+	res = roundTrip(t, conn, reader, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	assert.False(t, res.Close)
+	assert.Equal(t, "keep-alive", res.Header.Get("Connection"))
+	res = roundTrip(t, conn, reader, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := startServer(t, okHandler, WithIdleTimeout(50*time.Millisecond))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Idle keep-alive connection is closed once the timeout expires
+	res := roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.False(t, res.Close)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	s := startServer(t, okHandler, WithReadHeaderTimeout(50*time.Millisecond))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: loc"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 408, res.StatusCode)
+	assert.True(t, res.Close)
+}
+
+func TestReadTimeout(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		if _, err := req.ReadBody(); err != nil {
+			return err
+		}
+		return okHandler(w, req)
+	}, WithReadTimeout(100*time.Millisecond), WithErrorLog(log.New(io.Discard, "", 0)))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: Body that doesn't arrive in time is answered with 408
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 408, res.StatusCode)
+	assert.True(t, res.Close)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		if req.Path == "/slow" {
+			time.Sleep(150 * time.Millisecond)
+		}
+		return okHandler(w, req)
+	}, WithWriteTimeout(50*time.Millisecond), WithErrorLog(log.New(io.Discard, "", 0)))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Fast response is written
+	res := roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+
+	// Test: Response written after the deadline is dropped with the connection
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		<-release
+		return okHandler(w, req)
+	})
+
+	busy, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer busy.Close()
+	_, err = busy.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	// Test: Shutdown waits for the in-flight request
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("shutdown returned with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-done)
+	res, err := http.ReadResponse(bufio.NewReader(busy), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	// Test: No new connections are accepted
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestShutdownIdle(t *testing.T) {
+	s := startServer(t, okHandler)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	// Test: Idle keep-alive connection is closed right away
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestServeUnix(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	path := filepath.Join(t.TempDir(), "http.sock")
+	s, err := Serve(0, okHandler, WithNetwork("unix"), WithAddr(path), WithConnState(func(conn net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	}))
+	require.NoError(t, err)
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	res := roundTrip(t, conn, bufio.NewReader(conn), "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	conn.Close()
+	require.NoError(t, s.Shutdown(context.Background()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateClosed}, states)
+}
+
+func TestShutdownNewConn(t *testing.T) {
+	var mu sync.Mutex
+	var closed int
+	s := startServer(t, okHandler, WithConnState(func(conn net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		if state == StateClosed {
+			closed++
+		}
+	}))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	// Test: Connection that hasn't sent a request doesn't hold up Shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Hook has seen the connection closed by the time Shutdown returns
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, closed)
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	s := startServer(t, okHandler, WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}), WithErrorLog(log.New(io.Discard, "", 0)))
+
+	// Test: Requests are served over TLS
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: pool})
+	require.NoError(t, err)
+	defer conn.Close()
+	res := roundTrip(t, conn, bufio.NewReader(conn), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+
+	// Test: Plain HTTP gets no response
+	plain, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = plain.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	plain.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = http.ReadResponse(bufio.NewReader(plain), nil)
+	assert.Error(t, err)
+}
+
+func TestErrorLog(t *testing.T) {
+	var logs strings.Builder
+	var mu sync.Mutex
+	s := startServer(t, okHandler, WithErrorLog(log.New(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return logs.Write(p)
+	}), "", 0)))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: Errors go to the configured logger
+	res := roundTrip(t, conn, bufio.NewReader(conn), "get / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 400, res.StatusCode)
+	// The error is logged before the connection is closed
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, logs.String(), "Error parsing request")
+}
+
+func TestHandlerError(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		switch req.RequestLine.RequestTarget {
+		case "/teapot":
+			return &HandlerError{StatusCode: response.StatusBadRequest, Message: "no coffee here"}
+		case "/bad-header":
+			w.Header().Set("X-Bad", "a\r\nb")
+			return &HandlerError{StatusCode: response.StatusNotFound, Message: "not found"}
+		case "/chunked":
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Header().Set("Content-Length", "100")
+			return errors.New("upstream failed")
+		case "/bad-write":
+			w.WriteStatusLine(response.StatusOK)
+			h := response.GetDefaultHeaders(0)
+			h.Set("Location", "/x\r\nSet-Cookie: admin=1")
+			if err := w.WriteHeaders(h); err != nil {
+				return err
+			}
+			return nil
+		case "/started":
+			okHandler(w, req)
+			return errors.New("failed after writing")
+		}
+		return errors.New("secret database error")
+	})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: HandlerError is rendered with its status and message
+	_, err = conn.Write([]byte("GET /teapot HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 400, res.StatusCode)
+	assert.Equal(t, "no coffee here\n", string(body))
+	assert.False(t, res.Close)
+
+	// Test: Plain errors become a 500 without leaking the message
+	_, err = conn.Write([]byte("GET /other HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 500, res.StatusCode)
+	assert.NotContains(t, string(body), "secret")
+
+	// Test: Invalid header set by the handler turns the error into a clean 500
+	res = roundTrip(t, conn, reader, "GET /bad-header HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 500, res.StatusCode)
+	assert.Empty(t, res.Header.Values("X-Bad"))
+	assert.False(t, res.Close)
+
+	// Test: Framing the handler set up is dropped from the error response
+	res = roundTrip(t, conn, reader, "GET /chunked HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 500, res.StatusCode)
+	assert.Empty(t, res.TransferEncoding)
+	assert.Empty(t, res.Header.Values("Trailer"))
+	assert.Equal(t, int64(len("Internal Server Error\n")), res.ContentLength)
+	assert.False(t, res.Close)
+
+	// Test: Error from WriteHeaders still gets a response, since nothing was
+	// written
+	res = roundTrip(t, conn, reader, "GET /bad-write HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 500, res.StatusCode)
+	assert.Empty(t, res.Header.Values("Set-Cookie"))
+	assert.False(t, res.Close)
+
+	// Test: Error after the response started closes the connection
+	res = roundTrip(t, conn, reader, "GET /started HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestBadRequest(t *testing.T) {
+	s := startServer(t, okHandler)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("get / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 400, res.StatusCode)
+	assert.True(t, res.Close)
+
+	// Test: Invalid percent-encoding in the target
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /a%zz HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 400, res.StatusCode)
+
+	// Test: Unsupported HTTP version
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/2.0\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 505, res.StatusCode)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		switch req.RequestLine.RequestTarget {
+		case "/started":
+			okHandler(w, req)
+		case "/status":
+			w.WriteStatusLine(response.StatusOK)
+		}
+		panic("boom")
+	}, WithErrorLog(log.New(io.Discard, "", 0)))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Panic before writing becomes a 500 and the connection survives
+	res := roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 500, res.StatusCode)
+	assert.False(t, res.Close)
+
+	// Test: Panic after only the status line still becomes a 500
+	res = roundTrip(t, conn, reader, "GET /status HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 500, res.StatusCode)
+	assert.False(t, res.Close)
+
+	// Test: Panic after writing aborts the connection
+	res = roundTrip(t, conn, reader, "GET /started HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestStreamingBody(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		if req.RequestLine.RequestTarget == "/echo" {
+			body, err := req.ReadBody()
+			if err != nil {
+				return err
+			}
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			_, err = w.WriteBody(body)
+			return err
+		}
+		return okHandler(w, req)
+	})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Handler reads a chunked body
+	_, err = conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(body))
+
+	// Test: Body the handler ignores doesn't break the next request
+	res = roundTrip(t, conn, reader, "POST /ignore HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	assert.Equal(t, 200, res.StatusCode)
+	res = roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+func TestUnreadBodyTimeout(t *testing.T) {
+	s := startServer(t, okHandler, WithReadHeaderTimeout(100*time.Millisecond))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Client that stops sending a body the handler ignored is dropped
+	// instead of holding the connection
+	res := roundTrip(t, conn, reader, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc")
+	assert.Equal(t, 200, res.StatusCode)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Shutdown doesn't wait for it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+}
+
+func TestLimits(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		if _, err := req.ReadBody(); err != nil {
+			return err
+		}
+		return okHandler(w, req)
+	}, WithMaxRequestLineBytes(32), WithMaxHeaderCount(3), WithMaxBodyBytes(4), WithErrorLog(log.New(io.Discard, "", 0)))
+
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"request line", "GET /" + strings.Repeat("a", 40) + " HTTP/1.1\r\nHost: localhost\r\n\r\n", 414},
+		{"header count", "GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", 431},
+		{"content length", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\n0123456789", 413},
+		{"chunked body", "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n", 413},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte(tt.raw))
+			require.NoError(t, err)
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, res.StatusCode)
+		})
+	}
+}
+
+func TestLenientHeaders(t *testing.T) {
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: a\r\n b\r\n\r\n"
+
+	// Test: Folded header is rejected by default
+	s := startServer(t, okHandler, WithErrorLog(log.New(io.Discard, "", 0)))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	res := roundTrip(t, conn, bufio.NewReader(conn), raw)
+	assert.Equal(t, 400, res.StatusCode)
+
+	// Test: Lenient server unfolds it
+	var got string
+	s = startServer(t, func(w *response.Writer, req *request.Request) error {
+		got = req.Headers.Get("X-Long")
+		return okHandler(w, req)
+	}, WithLenientHeaders())
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	res = roundTrip(t, conn, bufio.NewReader(conn), raw)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "a b", got)
+}
+
+func TestExpectContinue(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		if req.Path == "/reject" {
+			return &HandlerError{StatusCode: response.StatusContentTooLarge, Message: "too large"}
+		}
+		if req.Path == "/status-first" {
+			w.WriteStatusLine(response.StatusCreated)
+		}
+		body, err := req.ReadBody()
+		if err != nil {
+			return err
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, err = w.WriteBody(body)
+		return err
+	})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: 100 Continue is sent when the handler reads the body
+	_, err = conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 100, res.StatusCode)
+	res = roundTrip(t, conn, reader, "hello")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.False(t, res.Close)
+
+	// Test: Status line set before reading the body doesn't hold back 100
+	_, err = conn.Write([]byte("POST /status-first HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	require.NoError(t, err)
+	res, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 100, res.StatusCode)
+	res = roundTrip(t, conn, reader, "hello")
+	assert.Equal(t, 201, res.StatusCode)
+
+	// Test: Handler rejects the request without asking for the body
+	_, err = conn.Write([]byte("POST /reject HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	require.NoError(t, err)
+	res, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 413, res.StatusCode)
+	assert.True(t, res.Close)
+
+	// Test: Unknown expectation
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	res = roundTrip(t, conn, bufio.NewReader(conn), "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: teapot\r\n\r\nhello")
+	assert.Equal(t, 417, res.StatusCode)
+}
+
+func TestHead(t *testing.T) {
+	s := startServer(t, okHandler)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: HEAD gets the GET headers without the body
+	_, err = conn.Write([]byte("HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(reader, &http.Request{Method: "HEAD"})
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int64(2), res.ContentLength)
+
+	// Test: Next response follows right after the headers
+	res = roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int64(2), res.ContentLength)
+}
+
+func TestImplicitResponse(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		switch req.Path {
+		case "/small":
+			_, err := io.WriteString(w, "small")
+			return err
+		case "/large":
+			_, err := w.Write(bytes.Repeat([]byte("x"), 10000))
+			return err
+		}
+		return nil
+	})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	read := func(raw string) (*http.Response, string) {
+		_, err := conn.Write([]byte(raw))
+		require.NoError(t, err)
+		res, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, string(body)
+	}
+
+	// Test: Small body gets a Content-Length
+	res, body := read("GET /small HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int64(5), res.ContentLength)
+	assert.Equal(t, "small", body)
+
+	// Test: Large body is chunked
+	res, body = read("GET /large HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Len(t, body, 10000)
+
+	// Test: Handler that writes nothing sends an empty 200
+	res, body = read("GET /empty HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "", body)
+	assert.False(t, res.Close)
+}
+
+func TestShortBody(t *testing.T) {
+	var logs strings.Builder
+	var mu sync.Mutex
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(10))
+		_, err := w.WriteBody([]byte("short"))
+		return err
+	}, WithErrorLog(log.New(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return logs.Write(p)
+	}), "", 0)))
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: Connection is closed after the short body
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Discrepancy is logged
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, logs.String(), "wrote 5 of 10 bytes")
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestTrailers(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		w.Header().Set("Trailer", "X-Content-Length")
+		n, err := io.WriteString(w, "streamed")
+		w.Trailer().Set("X-Content-Length", strconv.Itoa(n))
+		return err
+	})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Trailers set while streaming reach the client
+	res := roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "8", res.Trailer.Get("X-Content-Length"))
+
+	// Test: Connection is still usable afterwards
+	res = roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+func TestDateAndServerHeaders(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) error {
+		switch req.Path {
+		case "/override":
+			w.Header().Set("Server", "custom")
+		case "/suppress":
+			w.Header().Del("Date")
+			w.Header().Del("Server")
+		}
+		return okHandler(w, req)
+	})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Date and Server are added by default
+	res := roundTrip(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), date, 2*time.Second)
+	assert.Equal(t, "httpfromtcp", res.Header.Get("Server"))
+
+	// Test: Handler overrides them
+	res = roundTrip(t, conn, reader, "GET /override HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, []string{"custom"}, res.Header.Values("Server"))
+
+	// Test: Handler suppresses them
+	res = roundTrip(t, conn, reader, "GET /suppress HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Empty(t, res.Header.Values("Date"))
+	assert.Empty(t, res.Header.Values("Server"))
+
+	// Test: Server name is configurable and can be left out
+	s = startServer(t, okHandler, WithServerName(""))
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	res = roundTrip(t, conn, bufio.NewReader(conn), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Empty(t, res.Header.Values("Server"))
+	assert.NotEmpty(t, res.Header.Get("Date"))
+}
+
+func TestDateCache(t *testing.T) {
+	var c dateCache
+	now := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+
+	// Test: IMF-fixdate in GMT
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", c.get(now.In(time.FixedZone("CET", 3600))))
+
+	// Test: Formatted once per second
+	first := c.current.Load()
+	c.get(now.Add(500 * time.Millisecond))
+	assert.Same(t, first, c.current.Load())
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:38 GMT", c.get(now.Add(time.Second)))
+}